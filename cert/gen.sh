@@ -23,3 +23,6 @@ openssl x509 -req -in client-req.pem -days 60 -CA ca-cert.pem -CAkey ca-key.pem
 
 echo "Client's signed certificate"
 openssl x509 -in client-cert.pem -noout -text
+
+# 6. Generate the ECDSA P-256 key signing the JWT access/refresh tokens (ES256)
+openssl ecparam -name prime256v1 -genkey -noout | openssl pkcs8 -topk8 -nocrypt -out jwt-key.pem
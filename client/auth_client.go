@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
@@ -13,8 +14,13 @@ type AuthClient struct {
 	username, password string
 }
 
-func (a *AuthClient) Login() (string, error) {
-	ctx := context.Background()
+// Login returns an access and a refresh token. The password is dropped
+// after the first successful login, use RefreshToken from then on.
+func (a *AuthClient) Login(ctx context.Context) (accessToken, refreshToken string, err error) {
+	if len(a.password) == 0 {
+		return "", "", errors.New("no password, it is dropped after the first login")
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
@@ -25,10 +31,41 @@ func (a *AuthClient) Login() (string, error) {
 
 	res, err := a.service.Login(ctx, req)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	a.password = ""
+	return res.GetAccessToken(), res.GetRefreshToken(), nil
+}
+
+// RefreshToken trades the refresh token for a new access and refresh token.
+func (a *AuthClient) RefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	req := &pb.RefreshTokenRequest{
+		RefreshToken: refreshToken,
+	}
+
+	res, err := a.service.RefreshToken(ctx, req)
+	if err != nil {
+		return "", "", err
+	}
+
+	return res.GetAccessToken(), res.GetRefreshToken(), nil
+}
+
+// Logout revokes the refresh token, ctx must carry the access token.
+func (a *AuthClient) Logout(ctx context.Context, refreshToken string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	req := &pb.LogoutRequest{
+		RefreshToken: refreshToken,
 	}
 
-	return res.AccessToken, nil
+	_, err := a.service.Logout(ctx, req)
+	return err
 }
 
 func NewAuthClient(cc *grpc.ClientConn,
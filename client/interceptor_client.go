@@ -2,30 +2,59 @@ package client
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"sync"
 	"time"
 
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"go.opentelemetry.io/otel"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+const (
+	refreshRetryDelay = 5 * time.Second
+	maxRefreshRetry   = 10
+)
+
+var tracer = otel.Tracer("github.com/TranQuocToan1996/go-pcBookgRPC/client")
+
 type AuthInterceptor struct {
-	client      *AuthClient
-	authMethods map[string]bool
-	accessToken string
+	client       *AuthClient
+	authMethods  map[string]bool
+	mutex        sync.RWMutex
+	accessToken  string
+	refreshToken string
+	// refreshErr stopped the refreshes, the tokens are dead
+	refreshErr error
+	done       chan struct{}
+	stopOnce   sync.Once
 }
 
 func NewAuthInterceptor(
 	client *AuthClient,
 	authMethods map[string]bool,
 	refreshTokenDuration time.Duration,
+) (*AuthInterceptor, error) {
+	return newAuthInterceptor(client, authMethods, refreshTokenDuration, refreshRetryDelay, maxRefreshRetry)
+}
+
+func newAuthInterceptor(
+	client *AuthClient,
+	authMethods map[string]bool,
+	refreshTokenDuration time.Duration,
+	retryDelay time.Duration,
+	maxRetry int,
 ) (*AuthInterceptor, error) {
 	interceptor := &AuthInterceptor{
 		client:      client,
 		authMethods: authMethods,
+		done:        make(chan struct{}),
 	}
 
-	err := interceptor.scheduleRefreshToken(refreshTokenDuration)
+	err := interceptor.scheduleRefreshToken(refreshTokenDuration, retryDelay, maxRetry)
 	if err != nil {
 		return nil, err
 	}
@@ -33,59 +62,119 @@ func NewAuthInterceptor(
 	return interceptor, nil
 }
 
-func (i *AuthInterceptor) scheduleRefreshToken(refreshTokenDuration time.Duration) error {
-	err := i.refreshToken()
+// scheduleRefreshToken logs in, then refreshes the tokens in the
+// background. The refreshes stop once the refresh token is rejected or
+// after maxRetry failed retries, Err then returns why.
+func (i *AuthInterceptor) scheduleRefreshToken(refreshTokenDuration time.Duration, retryDelay time.Duration, maxRetry int) error {
+	err := i.login()
 	if err != nil {
 		return err
 	}
 
 	go func() {
-		ticket := time.NewTicker(refreshTokenDuration)
-		refreshNow := make(chan time.Time)
+		wait := refreshTokenDuration
 		retry := 0
 		for {
-			if retry > 10 {
-				log.Fatal("exceed 10 time retry refresh token")
+			select {
+			case <-i.done:
+				return
+			case <-time.After(wait):
 			}
 
-			select {
-			case <-ticket.C:
-				err := i.refreshToken()
-				if err != nil {
-					log.Println(err)
-					refreshNow <- time.Now()
-					retry++
-				} else {
-					retry = 0
-				}
-			case <-refreshNow:
-				err := i.refreshToken()
-				if err != nil {
-					time.Sleep(time.Second * 5)
-					log.Println(err)
-					refreshNow <- time.Now()
-					retry++
-				} else {
-					retry = 0
-				}
+			err := i.refreshTokens()
+			if err == nil {
+				wait = refreshTokenDuration
+				retry = 0
+				continue
 			}
+			if status.Code(err) == codes.Unauthenticated || retry >= maxRetry {
+				slog.Error("cant refresh token, giving up", "retries", retry, "error", err)
+				i.mutex.Lock()
+				i.refreshErr = err
+				i.mutex.Unlock()
+				return
+			}
+
+			slog.Warn("cant refresh token, retrying", "retry", retry+1, "error", err)
+			wait = retryDelay
+			retry++
 		}
 	}()
 
 	return nil
 }
 
-func (i *AuthInterceptor) refreshToken() error {
-	token, err := i.client.Login()
+// Err returns why the tokens could not be refreshed anymore, nil while
+// they are. The calls needing a token then fail with Unauthenticated, log
+// in with a new interceptor.
+func (i *AuthInterceptor) Err() error {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.refreshErr
+}
+
+func (i *AuthInterceptor) login() (err error) {
+	ctx, span := tracer.Start(context.Background(), "AuthInterceptor.login")
+	defer func() {
+		service.EndSpan(span, err)
+	}()
+
+	accessToken, refreshToken, err := i.client.Login(ctx)
+	if err != nil {
+		return err
+	}
+
+	i.setTokens(accessToken, refreshToken)
+	return nil
+}
+
+func (i *AuthInterceptor) refreshTokens() (err error) {
+	ctx, span := tracer.Start(context.Background(), "AuthInterceptor.refreshTokens")
+	defer func() {
+		service.EndSpan(span, err)
+	}()
+
+	i.mutex.RLock()
+	refreshToken := i.refreshToken
+	i.mutex.RUnlock()
+
+	accessToken, refreshToken, err := i.client.RefreshToken(ctx, refreshToken)
 	if err != nil {
 		return err
 	}
 
-	i.accessToken = token
-	log.Printf("token refresh: %v", token)
+	i.setTokens(accessToken, refreshToken)
+	slog.Info("tokens refreshed")
 	return nil
 }
 
+func (i *AuthInterceptor) setTokens(accessToken, refreshToken string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.accessToken = accessToken
+	i.refreshToken = refreshToken
+}
+
+// Logout stops refreshing and revokes the tokens on the server. It may be
+// called again, the server then rejects the revoked tokens.
+func (i *AuthInterceptor) Logout() error {
+	i.stopOnce.Do(func() {
+		close(i.done)
+	})
+
+	i.mutex.RLock()
+	refreshToken := i.refreshToken
+	i.mutex.RUnlock()
+
+	ctx, err := i.attachToken(context.Background())
+	if err != nil {
+		return err
+	}
+	return i.client.Logout(ctx, refreshToken)
+}
+
 func (i *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
 	return func(ctx context.Context,
 		method string,
@@ -95,17 +184,27 @@ func (i *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
 		opts ...grpc.CallOption,
 	) error {
 
-		log.Println("Unary client" + method)
+		slog.Debug("unary call", "method", method)
 		if i.authMethods[method] {
-			return invoker(i.attachToken(ctx), method, req, reply, cc, opts...)
+			ctx, err := i.attachToken(ctx)
+			if err != nil {
+				return err
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
 		}
 
-		return invoker(i.attachToken(ctx), method, req, reply, cc, opts...)
+		return invoker(ctx, method, req, reply, cc, opts...)
 	}
 }
 
-func (i *AuthInterceptor) attachToken(ctx context.Context) context.Context {
-	return metadata.AppendToOutgoingContext(ctx, "authorization", i.accessToken)
+func (i *AuthInterceptor) attachToken(ctx context.Context) (context.Context, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	if i.refreshErr != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "tokens expired, cant refresh them: %v", i.refreshErr)
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", i.accessToken), nil
 }
 
 func (i *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
@@ -116,13 +215,16 @@ func (i *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
 		streamer grpc.Streamer,
 		opts ...grpc.CallOption) (grpc.ClientStream, error) {
 
-		log.Println("Stream client" + method)
+		slog.Debug("stream call", "method", method)
 
 		if i.authMethods[method] {
-			return streamer(i.attachToken(ctx), desc, cc, method, opts...)
+			ctx, err := i.attachToken(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return streamer(ctx, desc, cc, method, opts...)
 		}
 
-		return streamer(i.attachToken(ctx), desc, cc, method, opts...)
+		return streamer(ctx, desc, cc, method, opts...)
 	}
 }
-w
\ No newline at end of file
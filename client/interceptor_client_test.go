@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// fakeAuthServer logs anyone in and fails every refresh with refreshCode.
+type fakeAuthServer struct {
+	pb.UnimplementedAuthServiceServer
+	refreshCode codes.Code
+	logins      atomic.Int32
+	refreshes   atomic.Int32
+}
+
+func (s *fakeAuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+	s.logins.Add(1)
+	if len(req.GetPassword()) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "incorrect username/password")
+	}
+	return &pb.LoginResponse{AccessToken: "access", RefreshToken: "refresh"}, nil
+}
+
+func (s *fakeAuthServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	s.refreshes.Add(1)
+	return nil, status.Error(s.refreshCode, "cant refresh")
+}
+
+func startFakeAuthServer(t *testing.T, server *fakeAuthServer) *grpc.ClientConn {
+	t.Helper()
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterAuthServiceServer(grpcServer, server)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func TestAuthInterceptorGivesUpRefreshing(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name      string
+		code      codes.Code
+		refreshes int32
+	}{
+		{name: "retries exhausted", code: codes.Unavailable, refreshes: 4},
+		{name: "refresh token rejected", code: codes.Unauthenticated, refreshes: 1},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := &fakeAuthServer{refreshCode: tc.code}
+			conn := startFakeAuthServer(t, server)
+			authClient := NewAuthClient(conn, "admin1", "secret-password")
+			method := "/pb.LaptopService/CreateLaptop"
+
+			interceptor, err := newAuthInterceptor(authClient, map[string]bool{method: true}, 10*time.Millisecond, 10*time.Millisecond, 3)
+			require.NoError(t, err)
+			defer interceptor.Logout()
+
+			require.Eventually(t, func() bool {
+				return interceptor.Err() != nil
+			}, 5*time.Second, 10*time.Millisecond)
+			require.Equal(t, tc.code, status.Code(interceptor.Err()))
+
+			// no more refreshes, and never a login without the password
+			time.Sleep(100 * time.Millisecond)
+			require.Equal(t, tc.refreshes, server.refreshes.Load())
+			require.EqualValues(t, 1, server.logins.Load())
+
+			called := false
+			err = interceptor.Unary()(context.Background(), method, nil, nil, conn,
+				func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					called = true
+					return nil
+				})
+			require.Equal(t, codes.Unauthenticated, status.Code(err))
+			require.False(t, called)
+		})
+	}
+}
@@ -5,13 +5,14 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
 	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -29,8 +30,13 @@ func NewLaptopClient(service pb.LaptopServiceClient) *LaptopClient {
 	return &LaptopClient{service}
 }
 
-func (c *LaptopClient) RateLaptop(list []LaptopRate) error {
-	ctx := context.Background()
+func (c *LaptopClient) RateLaptop(list []LaptopRate) (err error) {
+	ctx, span := tracer.Start(context.Background(), "LaptopClient.RateLaptop")
+	span.SetAttributes(attribute.Int("pcbook.ratings", len(list)))
+	defer func() {
+		service.EndSpan(span, err)
+	}()
+
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
@@ -44,7 +50,7 @@ func (c *LaptopClient) RateLaptop(list []LaptopRate) error {
 		for {
 			res, err := stream.Recv()
 			if err == io.EOF {
-				log.Print("[RateLaptop] EOF no more response from client.")
+				slog.Debug("no more rating response")
 				chanErr <- nil
 				return
 			}
@@ -52,7 +58,7 @@ func (c *LaptopClient) RateLaptop(list []LaptopRate) error {
 				chanErr <- err
 				return
 			}
-			log.Print("receive resp ", res)
+			slog.Info("laptop rated", "laptop_id", res.GetLaptopId(), "rated_count", res.GetRatedCount(), "average_score", res.GetAverageScore())
 		}
 	}()
 
@@ -67,7 +73,7 @@ func (c *LaptopClient) RateLaptop(list []LaptopRate) error {
 			return fmt.Errorf("cant send stream req: %v - %v", err, stream.RecvMsg(nil))
 		}
 
-		log.Print("send req", req)
+		slog.Debug("rating sent", "laptop_id", req.GetLaptopId(), "score", req.GetScore())
 	}
 
 	err = stream.CloseSend()
@@ -79,19 +85,25 @@ func (c *LaptopClient) RateLaptop(list []LaptopRate) error {
 
 }
 
-func (c *LaptopClient) UploadImage(laptopID string, path string) *pb.UploadImageResponse {
+func (c *LaptopClient) UploadImage(laptopID string, path string) (res *pb.UploadImageResponse, err error) {
 	file, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cant open image: %w", err)
 	}
 	defer file.Close()
 
-	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	ctx, span := tracer.Start(context.Background(), "LaptopClient.UploadImage")
+	span.SetAttributes(attribute.String("pcbook.laptop_id", laptopID))
+	defer func() {
+		service.EndSpan(span, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	stream, err := c.service.UploadImage(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cant upload image: %w", err)
 	}
 	req := &pb.UploadImageRequest{
 		Data: &pb.UploadImageRequest_Info{
@@ -104,8 +116,7 @@ func (c *LaptopClient) UploadImage(laptopID string, path string) *pb.UploadImage
 
 	err = stream.Send(req)
 	if err != nil {
-		err2 := stream.RecvMsg(nil)
-		log.Fatal(err, err2)
+		return nil, fmt.Errorf("cant send image info: %w: %v", err, stream.RecvMsg(nil))
 	}
 
 	reader := bufio.NewReader(file)
@@ -119,7 +130,7 @@ func (c *LaptopClient) UploadImage(laptopID string, path string) *pb.UploadImage
 			break
 		}
 		if err != nil {
-			return nil
+			return nil, fmt.Errorf("cant read image: %w", err)
 		}
 
 		size += n
@@ -131,62 +142,137 @@ func (c *LaptopClient) UploadImage(laptopID string, path string) *pb.UploadImage
 		}
 		err = stream.Send(req)
 		if err != nil {
-			err2 := stream.RecvMsg(nil)
-			log.Fatal(err, err2)
+			return nil, fmt.Errorf("cant send image chunk: %w: %v", err, stream.RecvMsg(nil))
 		}
-		log.Println("Readsize:", size)
+		slog.Debug("image chunk sent", "size", size)
 	}
 
-	res, err := stream.CloseAndRecv()
+	res, err = stream.CloseAndRecv()
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cant upload image: %w", err)
 	}
 
-	log.Printf("receive id %v and size %v from server reponse", res.Id, res.Size)
+	slog.Info("image uploaded", "image_id", res.GetId(), "size", res.GetSize())
+	span.SetAttributes(attribute.Int("pcbook.image_size", size))
 
-	return res
+	return res, nil
 }
 
-func (c *LaptopClient) SearchLaptop(filter *pb.Filter) {
-	log.Print("search filter", filter)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+func (c *LaptopClient) SearchLaptop(filter *pb.Filter) (err error) {
+	slog.Debug("search laptops", "filter", filter.String())
+	ctx, span := tracer.Start(context.Background(), "LaptopClient.SearchLaptop")
+	defer func() {
+		service.EndSpan(span, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 	req := &pb.SearchLaptopRequest{Filter: filter}
 	stream, err := c.service.SearchLaptop(ctx, req)
 	if err != nil {
-		log.Fatal("cant search laptop", err)
+		return fmt.Errorf("cant search laptop: %w", err)
 	}
 
+	found := 0
 	for {
 		res, err := stream.Recv()
 		if err == io.EOF {
-			return
+			span.SetAttributes(attribute.Int("pcbook.laptops_found", found))
+			return nil
 		}
 		if err != nil {
-			log.Fatal("cant receive stream resp", err)
+			return fmt.Errorf("cant receive laptop: %w", err)
 		}
+		found++
 		laptop := res.GetLaptop()
-		log.Printf("found laptop %v - %v", laptop.Id, laptop.Brand)
+		slog.Info("laptop found", "laptop_id", laptop.GetId(), "brand", laptop.GetBrand())
+	}
+}
+
+// WatchLaptops logs the laptops matching the filter and their changes until
+// ctx is done. A broken watch is resumed from the last token received.
+func (c *LaptopClient) WatchLaptops(ctx context.Context, filter *pb.Filter) error {
+	resumeToken := ""
+	for {
+		err := c.watchLaptops(ctx, filter, &resumeToken)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		switch status.Code(err) {
+		case codes.Unavailable, codes.Aborted:
+			slog.Warn("watch interrupted, resuming", "resume_token", resumeToken, "error", err)
+		case codes.OutOfRange:
+			slog.Warn("resume token expired, watching from scratch", "resume_token", resumeToken)
+			resumeToken = ""
+		default:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
 	}
 }
 
-func (c *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
+func (c *LaptopClient) watchLaptops(ctx context.Context, filter *pb.Filter, resumeToken *string) (err error) {
+	ctx, span := tracer.Start(ctx, "LaptopClient.WatchLaptops")
+	span.SetAttributes(attribute.String("pcbook.resume_token", *resumeToken))
+	defer func() {
+		service.EndSpan(span, err)
+	}()
+
+	req := &pb.WatchLaptopsRequest{Filter: filter, ResumeToken: *resumeToken}
+	stream, err := c.service.WatchLaptops(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(res.GetResumeToken()) > 0 {
+			*resumeToken = res.GetResumeToken()
+		}
+		laptop := res.GetLaptop()
+		if laptop == nil {
+			continue
+		}
+		slog.Info("laptop event", "event", res.GetEvent().String(), "laptop_id", laptop.GetId(), "brand", laptop.GetBrand())
+	}
+}
+
+// CreateLaptop saves the laptop, one already saved is not an error.
+func (c *LaptopClient) CreateLaptop(laptop *pb.Laptop) (err error) {
 
 	req := &pb.CreateLaptopRequest{
 		Laptop: laptop,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, span := tracer.Start(context.Background(), "LaptopClient.CreateLaptop")
+	defer func() {
+		service.EndSpan(span, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
 	res, err := c.service.CreateLaptop(ctx, req)
 	if err != nil {
 		st, ok := status.FromError(err)
 		if ok && st.Code() == codes.AlreadyExists {
-			log.Print("laptop already exist")
-		} else {
-			log.Fatal("cant create laptop ", err)
+			slog.Info("laptop already exists", "laptop_id", laptop.GetId())
+			return nil
 		}
+		return fmt.Errorf("cant create laptop: %w", err)
 	}
 
-	log.Printf("create laptop with id %v", res.Id)
+	slog.Info("laptop created", "laptop_id", res.GetId())
+	return nil
 }
@@ -1,26 +1,28 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/TranQuocToan1996/go-pcBookgRPC/client"
 	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
 	"github.com/TranQuocToan1996/go-pcBookgRPC/sample"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 const (
-	username        = "admin1"
-	password        = "admin1"
-	refreshDuration = 30 * time.Second
+	refreshDuration = 10 * time.Minute
+	serviceName     = "pcbook-client"
 )
 
 func authMethods() map[string]bool {
@@ -30,8 +32,12 @@ func authMethods() map[string]bool {
 
 	return map[string]bool{
 		laptopServicePath + "CreateLaptop": true,
+		laptopServicePath + "SearchLaptop": true,
 		laptopServicePath + "UploadImage":  true,
 		laptopServicePath + "RateLaptop":   true,
+		laptopServicePath + "UpdateLaptop": true,
+		laptopServicePath + "DeleteLaptop": true,
+		laptopServicePath + "WatchLaptops": true,
 	}
 }
 
@@ -61,11 +67,52 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	return credentials.NewTLS(config), nil
 }
 
+// fatal logs the error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
 	port := flag.String("serverport", "8080", "server port")
 	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
+	username := flag.String("username", "admin1", "user logging in, an admin of the server seed_users")
+	password := flag.String("password", "", "password of -username, PCBOOK_PASSWORD if empty")
+	traceExporter := flag.String("trace-exporter", service.TraceExporterNone, "where the spans go: none, stdout or otlp")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "host:port of the OTLP gRPC collector, OTEL_EXPORTER_OTLP_ENDPOINT if empty")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "send the spans to the OTLP collector without TLS")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "lowest level logged: debug, info, warn or error")
 	flag.Parse()
-	log.Printf("calling on port %v, tls: %t", *port, *enableTLS)
+	if len(*password) == 0 {
+		*password = os.Getenv("PCBOOK_PASSWORD")
+	}
+
+	logger, err := service.NewLogger(os.Stderr, logLevel, "text")
+	if err != nil {
+		fatal("cant create logger", err)
+	}
+	slog.SetDefault(logger)
+	slog.Info("calling server", "port", *port, "tls", *enableTLS)
+
+	shutdownTracing, err := service.SetupTracing(context.Background(), service.TracingConfig{
+		ServiceName:  serviceName,
+		Exporter:     *traceExporter,
+		OTLPEndpoint: *otlpEndpoint,
+		OTLPInsecure: *otlpInsecure,
+		SampleRatio:  1,
+	})
+	if err != nil {
+		fatal("cant set up tracing", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			slog.Error("cant flush the spans", "error", err)
+		}
+	}()
 	adddress := fmt.Sprintf("0.0.0.0:%v", *port)
 
 	transportOtps := grpc.WithTransportCredentials(insecure.NewCredentials())
@@ -73,69 +120,97 @@ func main() {
 	if *enableTLS {
 		loadTLSCredentials, err := loadTLSCredentials()
 		if err != nil {
-			log.Fatal(err)
+			fatal("cant load TLS credentials", err)
 		}
 		transportOtps = grpc.WithTransportCredentials(loadTLSCredentials)
 	}
 
-	cc1, err := grpc.Dial(adddress, transportOtps)
+	// the trace context goes in the gRPC metadata
+	cc1, err := grpc.Dial(adddress,
+		transportOtps,
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	)
 	if err != nil {
-		log.Fatal(err)
+		fatal("cant dial server", err)
 	}
 
-	authClient := client.NewAuthClient(cc1, username, password)
+	authClient := client.NewAuthClient(cc1, *username, *password)
 	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
 	if err != nil {
-		log.Fatal(err)
+		fatal("cant log in", err)
 	}
 
 	cc2, err := grpc.Dial(adddress,
 		transportOtps,
-		grpc.WithUnaryInterceptor(interceptor.Unary()),
-		grpc.WithStreamInterceptor(interceptor.Stream()),
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), interceptor.Unary()),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(), interceptor.Stream()),
 	)
 	if err != nil {
-		log.Fatal(err)
+		fatal("cant dial server", err)
 	}
 
 	laptopClient := client.NewLaptopClient(pb.NewLaptopServiceClient(cc2))
-	testRateLaptop(laptopClient)
-
+	err = testRateLaptop(laptopClient)
+	if err != nil {
+		fatal("cant rate laptops", err)
+	}
 }
 
-func testRateLaptop(laptopClient *client.LaptopClient) {
+func testRateLaptop(laptopClient *client.LaptopClient) error {
 	list := [3]client.LaptopRate{}
 	for i := 0; i < len(list); i++ {
 		laptop := sample.NewLaptop()
 		list[i].LaptopID = laptop.GetId()
 		list[i].Score = sample.RandomLaptopScore()
-		laptopClient.CreateLaptop(laptop)
+		err := laptopClient.CreateLaptop(laptop)
+		if err != nil {
+			return err
+		}
 	}
 
 	for i := 0; i < len(list); i++ {
 		err := laptopClient.RateLaptop(list[:])
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
-
+	return nil
 }
 
-func testCreateLaptop(laptopClient *client.LaptopClient) {
-	laptopClient.CreateLaptop(sample.NewLaptop())
+func testCreateLaptop(laptopClient *client.LaptopClient) error {
+	return laptopClient.CreateLaptop(sample.NewLaptop())
 }
 
-func testUploadImage(laptopClient client.LaptopClient) {
+func testUploadImage(laptopClient *client.LaptopClient) error {
 	laptop := sample.NewLaptop()
-	laptopClient.CreateLaptop(laptop)
-	laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.png")
+	err := laptopClient.CreateLaptop(laptop)
+	if err != nil {
+		return err
+	}
+	_, err = laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.png")
+	return err
 }
 
-func testSearchLaptop(laptopClient *client.LaptopClient) {
+func testSearchLaptop(laptopClient *client.LaptopClient) error {
 	for i := 0; i < 10; i++ {
-		laptopClient.CreateLaptop(sample.NewLaptop())
+		err := laptopClient.CreateLaptop(sample.NewLaptop())
+		if err != nil {
+			return err
+		}
+	}
+
+	filter := &pb.Filter{
+		MaxPriceUsd: 3000,
+		MinCpuCores: 4,
+		MinCpuGhz:   2.5,
+		MinRam:      &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE},
 	}
 
+	return laptopClient.SearchLaptop(filter)
+}
+
+func testWatchLaptops(laptopClient *client.LaptopClient) error {
 	filter := &pb.Filter{
 		MaxPriceUsd: 3000,
 		MinCpuCores: 4,
@@ -143,5 +218,13 @@ func testSearchLaptop(laptopClient *client.LaptopClient) {
 		MinRam:      &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE},
 	}
 
-	laptopClient.SearchLaptop(filter)
+	go laptopClient.WatchLaptops(context.Background(), filter)
+
+	for i := 0; i < 10; i++ {
+		err := laptopClient.CreateLaptop(sample.NewLaptop())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variables overriding the config file,
+// named after the YAML path: server.port is PCBOOK_SERVER_PORT.
+const envPrefix = "PCBOOK_"
+
+// placeholderSecrets were shipped as JWT secrets and must not sign tokens.
+var placeholderSecrets = map[string]bool{
+	"Need to generate key":              true,
+	"change-me-to-a-long-random-secret": true,
+}
+
+// Config of the server. The YAML file is read first, then the environment
+// variables and the flags override it. Fields tagged secret are redacted
+// when printed.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Auth      AuthConfig      `yaml:"auth"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Log       LogConfig       `yaml:"log"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	SeedUsers []SeedUser      `yaml:"seed_users"`
+}
+
+type ServerConfig struct {
+	Port     int    `yaml:"port"`
+	TLS      bool   `yaml:"tls"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// CAFile signs the client certificates.
+	CAFile string `yaml:"ca_file"`
+	// ClientAuth is require, every caller sends a client certificate, or
+	// if_given, the callers without one (browsers) use a token or an API key.
+	ClientAuth string `yaml:"client_auth"`
+	// CORSOrigins browsers may call gRPC-Web and REST from, "*" for any.
+	CORSOrigins       []string      `yaml:"cors_origins"`
+	ShutdownGrace     time.Duration `yaml:"shutdown_grace"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// MetricsAddress serves /metrics, apart from the public port since it
+	// needs no token.
+	MetricsAddress string `yaml:"metrics_address"`
+}
+
+const (
+	clientAuthRequire = "require"
+	clientAuthIfGiven = "if_given"
+)
+
+type AuthConfig struct {
+	// JWTSecret signs the tokens with HS256 when there is no JWTKey.
+	JWTSecret string `yaml:"jwt_secret" secret:"true"`
+	// JWTKey is a PEM RSA/ECDSA private key signing the tokens.
+	JWTKey   string `yaml:"jwt_key"`
+	JWTKeyID string `yaml:"jwt_key_id"`
+	// JWTVerifyKeys are the previous public keys still accepted.
+	JWTVerifyKeys        verifyKeys    `yaml:"jwt_verify_keys"`
+	TokenDuration        time.Duration `yaml:"token_duration"`
+	RefreshTokenDuration time.Duration `yaml:"refresh_token_duration"`
+	PolicyFile           string        `yaml:"policy_file"`
+}
+
+// OIDCConfig turns on the OIDC login when IssuerURL is set, see
+// service.OIDCConfig.
+type OIDCConfig struct {
+	IssuerURL     string    `yaml:"issuer_url"`
+	ClientID      string    `yaml:"client_id"`
+	ClientSecret  string    `yaml:"client_secret" secret:"true"`
+	RedirectURL   string    `yaml:"redirect_url"`
+	UsernameClaim string    `yaml:"username_claim"`
+	GroupsClaim   string    `yaml:"groups_claim"`
+	Roles         oidcRoles `yaml:"roles"`
+	DefaultRole   string    `yaml:"default_role"`
+}
+
+type StorageConfig struct {
+	ImageFolder string `yaml:"image_folder"`
+	AuditLog    string `yaml:"audit_log"`
+	// AuditKey signs the audit log chain.
+	AuditKey string `yaml:"audit_key" secret:"true"`
+}
+
+// TracingConfig exports the spans, see service.TracingConfig.
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp.
+	Exporter     string  `yaml:"exporter"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	OTLPInsecure bool    `yaml:"otlp_insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error.
+	Level slog.Level `yaml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format"`
+}
+
+// RateLimitConfig limits the calls of every user, API key or peer IP, see
+// service.RateLimits.
+type RateLimitConfig struct {
+	Methods methodRateLimits `yaml:"methods"`
+	// PeerRate and PeerBurst limit every client IP, all methods together,
+	// before the auth. A PeerRate of 0 lifts the limit.
+	PeerRate   float64 `yaml:"peer_rate"`
+	PeerBurst  int     `yaml:"peer_burst"`
+	MaxStreams int     `yaml:"max_streams"`
+}
+
+// SeedUser is created at startup.
+type SeedUser struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password" secret:"true"`
+	Role         string `yaml:"role"`
+	Organization string `yaml:"organization"`
+}
+
+// verifyKeys is a list of kid=path, a comma separated string in the
+// environment and the flags.
+type verifyKeys []verifyKey
+
+type verifyKey struct {
+	KeyID string `yaml:"kid"`
+	Path  string `yaml:"path"`
+}
+
+func (keys *verifyKeys) UnmarshalText(text []byte) error {
+	*keys = nil
+	for _, entry := range splitList(string(text)) {
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid verification key %q, expect kid=path", entry)
+		}
+		*keys = append(*keys, verifyKey{KeyID: kid, Path: path})
+	}
+	return nil
+}
+
+// methodRateLimits is a list of method=rate:burst, a comma separated string
+// in the environment and the flags.
+type methodRateLimits []methodRateLimit
+
+type methodRateLimit struct {
+	Method string  `yaml:"method"`
+	Rate   float64 `yaml:"rate"`
+	Burst  int     `yaml:"burst"`
+}
+
+func (limits *methodRateLimits) UnmarshalText(text []byte) error {
+	*limits = nil
+	for _, entry := range splitList(string(text)) {
+		method, limit, ok := strings.Cut(entry, "=")
+		rate, burst, ok2 := strings.Cut(limit, ":")
+		if !ok || !ok2 {
+			return fmt.Errorf("invalid rate limit %q, expect method=rate:burst", entry)
+		}
+		parsedRate, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rate in %q, expect a number", entry)
+		}
+		parsedBurst, err := strconv.Atoi(burst)
+		if err != nil {
+			return fmt.Errorf("invalid burst in %q, expect a number", entry)
+		}
+		*limits = append(*limits, methodRateLimit{Method: method, Rate: parsedRate, Burst: parsedBurst})
+	}
+	return nil
+}
+
+func (limits methodRateLimits) String() string {
+	entries := make([]string, 0, len(limits))
+	for _, limit := range limits {
+		entries = append(entries, fmt.Sprintf("%v=%v:%v", limit.Method, limit.Rate, limit.Burst))
+	}
+	return strings.Join(entries, ",")
+}
+
+// RateLimits converts the config for service.NewRateLimiter.
+func (c RateLimitConfig) RateLimits() service.RateLimits {
+	limits := service.RateLimits{
+		Methods:    make(map[string]service.RateLimit),
+		Peer:       service.RateLimit{Rate: c.PeerRate, Burst: c.PeerBurst},
+		MaxStreams: c.MaxStreams,
+	}
+	for _, limit := range c.Methods {
+		limits.Methods[limit.Method] = service.RateLimit{Rate: limit.Rate, Burst: limit.Burst}
+	}
+	return limits
+}
+
+// oidcRoles is a list of group=role, a comma separated string in the
+// environment and the flags.
+type oidcRoles []service.OIDCRole
+
+func (roles *oidcRoles) UnmarshalText(text []byte) error {
+	*roles = nil
+	for _, entry := range splitList(string(text)) {
+		group, role, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid OIDC role %q, expect group=role", entry)
+		}
+		*roles = append(*roles, service.OIDCRole{Group: group, Role: role})
+	}
+	return nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              8080,
+			CertFile:          "cert/server-cert.pem",
+			KeyFile:           "cert/server-key.pem",
+			CAFile:            "cert/ca-cert.pem",
+			ClientAuth:        clientAuthRequire,
+			ShutdownGrace:     30 * time.Second,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MetricsAddress:    "localhost:9090",
+		},
+		Auth: AuthConfig{
+			JWTKeyID:             "pcbook-1",
+			TokenDuration:        15 * time.Minute,
+			RefreshTokenDuration: 7 * 24 * time.Hour,
+			PolicyFile:           "policy.yaml",
+		},
+		OIDC: OIDCConfig{
+			ClientID:      "pcbook",
+			RedirectURL:   "http://localhost:8080/v1/auth/oidc/callback",
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+		},
+		Storage: StorageConfig{
+			ImageFolder: "./img",
+			AuditLog:    "audit.log",
+		},
+		Tracing: TracingConfig{
+			Exporter:    service.TraceExporterNone,
+			SampleRatio: 1,
+		},
+		Log: LogConfig{
+			Level:  slog.LevelInfo,
+			Format: "text",
+		},
+		RateLimit: RateLimitConfig{
+			Methods:    defaultMethodRateLimits(),
+			PeerRate:   service.DefaultRateLimits.Peer.Rate,
+			PeerBurst:  service.DefaultRateLimits.Peer.Burst,
+			MaxStreams: service.DefaultRateLimits.MaxStreams,
+		},
+	}
+}
+
+// defaultMethodRateLimits lists service.DefaultRateLimits, sorted so that
+// the flag usage is stable.
+func defaultMethodRateLimits() methodRateLimits {
+	var limits methodRateLimits
+	for method, limit := range service.DefaultRateLimits.Methods {
+		limits = append(limits, methodRateLimit{Method: method, Rate: limit.Rate, Burst: limit.Burst})
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		return limits[i].Method < limits[j].Method
+	})
+	return limits
+}
+
+// configFlags are the command line flags and the config field they set.
+var configFlags = []struct {
+	name  string
+	path  string
+	usage string
+}{
+	{"serverport", "server.port", "server port"},
+	{"tls", "server.tls", "enable SSL/TLS"},
+	{"client-auth", "server.client_auth", "with -tls, require a client certificate or only verify it if_given"},
+	{"cors-origins", "server.cors_origins", "comma separated origins browsers may call gRPC-Web and REST from, * for any"},
+	{"metrics-address", "server.metrics_address", "host:port serving the Prometheus metrics, keep it private"},
+	{"shutdown-grace", "server.shutdown_grace", "time given to the running calls to finish on SIGTERM"},
+	{"jwt-key", "auth.jwt_key", "PEM RSA/ECDSA private key signing the tokens, HS256 secret if empty"},
+	{"jwt-kid", "auth.jwt_key_id", "key id of -jwt-key"},
+	{"jwt-verify-keys", "auth.jwt_verify_keys", "comma separated kid=path of previous keys still accepted"},
+	{"policy", "auth.policy_file", "YAML/JSON access policy, reloaded on SIGHUP"},
+	{"oidc-issuer", "oidc.issuer_url", "OIDC identity provider URL, OIDC login is off if empty"},
+	{"oidc-client-id", "oidc.client_id", "OIDC client id"},
+	{"oidc-client-secret", "oidc.client_secret", "OIDC client secret"},
+	{"oidc-redirect-url", "oidc.redirect_url", "FinishOIDCLogin URL the provider redirects to"},
+	{"oidc-username-claim", "oidc.username_claim", "ID token claim used as username"},
+	{"oidc-groups-claim", "oidc.groups_claim", "ID token claim listing the groups"},
+	{"oidc-default-role", "oidc.default_role", "role of the users in none of -oidc-roles, rejected if empty"},
+	{"oidc-roles", "oidc.roles", "comma separated group=role, the first match wins"},
+	{"audit-log", "storage.audit_log", "append only JSON lines audit log"},
+	{"trace-exporter", "tracing.exporter", "where the spans go: none, stdout or otlp"},
+	{"otlp-endpoint", "tracing.otlp_endpoint", "host:port of the OTLP gRPC collector, OTEL_EXPORTER_OTLP_ENDPOINT if empty"},
+	{"otlp-insecure", "tracing.otlp_insecure", "send the spans to the OTLP collector without TLS"},
+	{"log-level", "log.level", "lowest level logged: debug, info, warn or error"},
+	{"log-format", "log.format", "log lines as text or json"},
+	{"rate-limits", "rate_limit.methods", "comma separated method=rate:burst calls per second of every caller, /package.Service/* and * match many methods"},
+	{"peer-rate", "rate_limit.peer_rate", "calls per second of every client IP, all methods together, 0 for no limit"},
+	{"peer-burst", "rate_limit.peer_burst", "burst of -peer-rate"},
+	{"max-streams", "rate_limit.max_streams", "streams every caller may keep open at once, 0 for no limit"},
+}
+
+// loadConfig reads the -config file, then applies the PCBOOK_ environment
+// variables and the flags set on the command line, and validates the
+// result.
+func loadConfig(flags *flag.FlagSet, args []string) (*Config, error) {
+	config := defaultConfig()
+
+	configFile := flags.String("config", os.Getenv(envPrefix+"CONFIG"), "YAML config file, "+envPrefix+"* environment variables and flags override it")
+	set := make(map[string]string)
+	for _, f := range configFlags {
+		field, ok := configField(config, f.path)
+		if !ok {
+			return nil, fmt.Errorf("flag %v sets unknown config field %v", f.name, f.path)
+		}
+		usage := f.usage
+		if !field.IsZero() {
+			usage = fmt.Sprintf("%v (default %v)", usage, field.Interface())
+		}
+		flags.Var(&configFlag{path: f.path, set: set, isBool: field.Kind() == reflect.Bool}, f.name, usage)
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*configFile) > 0 {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("cant read config: %w", err)
+		}
+		decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("cant parse config %v: %w", *configFile, err)
+		}
+	}
+
+	var problems []string
+	walkConfig(reflect.ValueOf(config).Elem(), "", func(path string, field reflect.Value, _ bool) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		err := setField(field, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", name, err))
+		}
+	})
+
+	flags.Visit(func(f *flag.Flag) {
+		configFlag, ok := f.Value.(*configFlag)
+		if !ok {
+			return
+		}
+		field, _ := configField(config, configFlag.path)
+		err := setField(field, set[configFlag.path])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("-%v: %v", f.Name, err))
+		}
+	})
+
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid config:\n  %v", strings.Join(problems, "\n  "))
+	}
+
+	return config, nil
+}
+
+func (c *Config) validate() []string {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problem("server.port %v is not a TCP port", c.Server.Port)
+	}
+	if c.Server.TLS {
+		for name, path := range map[string]string{
+			"server.cert_file": c.Server.CertFile,
+			"server.key_file":  c.Server.KeyFile,
+			"server.ca_file":   c.Server.CAFile,
+		} {
+			_, err := os.Stat(path)
+			if err != nil {
+				problem("%v: %v", name, err)
+			}
+		}
+	}
+	if c.Server.ClientAuth != clientAuthRequire && c.Server.ClientAuth != clientAuthIfGiven {
+		problem("server.client_auth %q is not %v or %v", c.Server.ClientAuth, clientAuthRequire, clientAuthIfGiven)
+	}
+	if c.Server.ShutdownGrace < 0 {
+		problem("server.shutdown_grace must not be negative")
+	}
+	if c.Server.ReadHeaderTimeout <= 0 {
+		problem("server.read_header_timeout must be positive")
+	}
+	if c.Server.IdleTimeout <= 0 {
+		problem("server.idle_timeout must be positive")
+	}
+	_, metricsPort, err := net.SplitHostPort(c.Server.MetricsAddress)
+	if err != nil {
+		problem("server.metrics_address %q is not a host:port", c.Server.MetricsAddress)
+	} else if metricsPort == strconv.Itoa(c.Server.Port) {
+		problem("server.metrics_address must not use the public port %v", c.Server.Port)
+	}
+
+	switch {
+	case len(c.Auth.JWTKey) > 0:
+	case len(c.Auth.JWTSecret) == 0:
+		problem("auth.jwt_key or auth.jwt_secret is needed")
+	case placeholderSecrets[c.Auth.JWTSecret]:
+		problem("auth.jwt_secret is a placeholder, generate a random one")
+	case len(c.Auth.JWTSecret) < 16:
+		problem("auth.jwt_secret needs at least 16 characters when there is no auth.jwt_key")
+	}
+	if len(c.Auth.JWTKey) > 0 && len(c.Auth.JWTKeyID) == 0 {
+		problem("auth.jwt_key_id is needed with auth.jwt_key")
+	}
+	if c.Auth.TokenDuration <= 0 {
+		problem("auth.token_duration must be positive")
+	}
+	if c.Auth.RefreshTokenDuration <= c.Auth.TokenDuration {
+		problem("auth.refresh_token_duration must be longer than auth.token_duration")
+	}
+	if len(c.Auth.PolicyFile) == 0 {
+		problem("auth.policy_file is missing")
+	}
+
+	if len(c.OIDC.IssuerURL) > 0 {
+		for name, value := range map[string]string{
+			"oidc.issuer_url":   c.OIDC.IssuerURL,
+			"oidc.redirect_url": c.OIDC.RedirectURL,
+		} {
+			parsed, err := url.Parse(value)
+			if err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 {
+				problem("%v %q is not an absolute URL", name, value)
+			}
+		}
+		if len(c.OIDC.ClientID) == 0 {
+			problem("oidc.client_id is needed with oidc.issuer_url")
+		}
+	}
+	for i, role := range c.OIDC.Roles {
+		if !isRole(role.Role) {
+			problem("oidc.roles[%d] has unknown role %q, expect one of %v", i, role.Role, roles)
+		}
+	}
+	if len(c.OIDC.DefaultRole) > 0 && !isRole(c.OIDC.DefaultRole) {
+		problem("oidc.default_role %q is unknown, expect one of %v", c.OIDC.DefaultRole, roles)
+	}
+
+	if len(c.Storage.ImageFolder) == 0 {
+		problem("storage.image_folder is missing")
+	}
+	if len(c.Storage.AuditLog) == 0 {
+		problem("storage.audit_log is missing")
+	}
+	if len(c.Storage.AuditKey) < 16 {
+		problem("storage.audit_key needs at least 16 characters")
+	}
+
+	switch c.Tracing.Exporter {
+	case service.TraceExporterNone, service.TraceExporterStdout, service.TraceExporterOTLP:
+	default:
+		problem("tracing.exporter %q is unknown, expect %v, %v or %v", c.Tracing.Exporter,
+			service.TraceExporterNone, service.TraceExporterStdout, service.TraceExporterOTLP)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problem("log.format %q is unknown, expect text or json", c.Log.Format)
+	}
+
+	methods := make(map[string]bool)
+	for i, limit := range c.RateLimit.Methods {
+		if !strings.HasPrefix(limit.Method, "/") && limit.Method != "*" {
+			problem("rate_limit.methods[%d] %q is not a full method, /package.Service/* or *", i, limit.Method)
+		}
+		if methods[limit.Method] {
+			problem("rate_limit.methods[%d] %v is listed twice", i, limit.Method)
+		}
+		methods[limit.Method] = true
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			problem("rate_limit.methods[%d] needs a positive rate and burst", i)
+		}
+	}
+	if c.RateLimit.PeerRate < 0 || (c.RateLimit.PeerRate > 0 && c.RateLimit.PeerBurst < 1) {
+		problem("rate_limit.peer_rate must be 0, or positive with a positive rate_limit.peer_burst")
+	}
+	if c.RateLimit.MaxStreams < 0 {
+		problem("rate_limit.max_streams must not be negative")
+	}
+
+	usernames := make(map[string]bool)
+	for i, user := range c.SeedUsers {
+		if len(user.Username) == 0 || len(user.Password) == 0 {
+			problem("seed_users[%d] needs a username and a password", i)
+		} else if err := service.ValidatePassword(user.Username, user.Password); err != nil {
+			problem("seed_users[%d] %v: %v", i, user.Username, err)
+		}
+		if usernames[user.Username] {
+			problem("seed_users[%d] %v is listed twice", i, user.Username)
+		}
+		usernames[user.Username] = true
+		if !isRole(user.Role) {
+			problem("seed_users[%d] has unknown role %q, expect one of %v", i, user.Role, roles)
+		}
+	}
+
+	return problems
+}
+
+// Redacted returns the config as YAML, secrets hidden.
+func (c *Config) Redacted() string {
+	redacted := *c
+	redacted.SeedUsers = append([]SeedUser(nil), c.SeedUsers...)
+	walkConfig(reflect.ValueOf(&redacted).Elem(), "", func(path string, field reflect.Value, secret bool) {
+		if secret && field.Kind() == reflect.String && field.Len() > 0 {
+			field.SetString("REDACTED")
+		}
+	})
+
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return fmt.Sprintf("cant print config: %v", err)
+	}
+	return string(data)
+}
+
+// walkConfig calls visit with every leaf field and its YAML path, going
+// into the lists of structs only to find the secrets.
+func walkConfig(value reflect.Value, path string, visit func(path string, field reflect.Value, secret bool)) {
+	for i := 0; i < value.NumField(); i++ {
+		structField := value.Type().Field(i)
+		name, _, _ := strings.Cut(structField.Tag.Get("yaml"), ",")
+		if len(path) > 0 {
+			name = path + "." + name
+		}
+
+		field := value.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			walkConfig(field, name, visit)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			if _, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+				visit(name, field, false)
+				continue
+			}
+			for j := 0; j < field.Len(); j++ {
+				walkConfig(field.Index(j), fmt.Sprintf("%v[%d]", name, j), func(path string, field reflect.Value, secret bool) {
+					if secret {
+						visit(path, field, secret)
+					}
+				})
+			}
+		default:
+			visit(name, field, structField.Tag.Get("secret") == "true")
+		}
+	}
+}
+
+func configField(config *Config, path string) (reflect.Value, bool) {
+	var found reflect.Value
+	walkConfig(reflect.ValueOf(config).Elem(), "", func(fieldPath string, field reflect.Value, _ bool) {
+		if fieldPath == path {
+			found = field
+		}
+	})
+	return found, found.IsValid()
+}
+
+// setField parses a value from the environment or the command line.
+func setField(field reflect.Value, value string) error {
+	if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expect true or false, got %q", value)
+		}
+		field.SetBool(parsed)
+	case int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expect a number, got %q", value)
+		}
+		field.SetInt(int64(parsed))
+	case float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expect a number, got %q", value)
+		}
+		field.SetFloat(parsed)
+	case time.Duration:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expect a duration such as 30s, got %q", value)
+		}
+		field.SetInt(int64(parsed))
+	case []string:
+		field.Set(reflect.ValueOf(splitList(value)))
+	default:
+		return fmt.Errorf("cant be set from a string, use the config file")
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) > 0 {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// configFlag records the value of a flag, applied over the config file and
+// the environment once they are read.
+type configFlag struct {
+	path   string
+	set    map[string]string
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil || f.set == nil {
+		return ""
+	}
+	return f.set[f.path]
+}
+
+func (f *configFlag) Set(value string) error {
+	f.set[f.path] = value
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
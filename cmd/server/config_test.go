@@ -0,0 +1,421 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testJWTSecret = "test-jwt-secret-long-enough"
+	testAuditKey  = "test-audit-key-long-enough"
+)
+
+// validConfig is the default config with the secrets it lacks.
+func validConfig() *Config {
+	config := defaultConfig()
+	config.Auth.JWTSecret = testJWTSecret
+	config.Storage.AuditKey = testAuditKey
+	return config
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func testLoadConfig(args ...string) (*Config, error) {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return loadConfig(flags, args)
+}
+
+func TestLoadConfigOrder(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 1000
+  shutdown_grace: 1m
+auth:
+  jwt_secret: `+testJWTSecret+`
+storage:
+  audit_key: `+testAuditKey+`
+`)
+
+	config, err := testLoadConfig("-config", path)
+	require.NoError(t, err)
+	require.Equal(t, 1000, config.Server.Port)
+	require.Equal(t, time.Minute, config.Server.ShutdownGrace)
+	require.Equal(t, 10*time.Second, config.Server.ReadHeaderTimeout)
+
+	t.Setenv("PCBOOK_SERVER_PORT", "2000")
+	t.Setenv("PCBOOK_SERVER_CORS_ORIGINS", "https://a.com, https://b.com")
+	config, err = testLoadConfig("-config", path)
+	require.NoError(t, err)
+	require.Equal(t, 2000, config.Server.Port)
+	require.Equal(t, []string{"https://a.com", "https://b.com"}, config.Server.CORSOrigins)
+	require.Equal(t, time.Minute, config.Server.ShutdownGrace)
+
+	config, err = testLoadConfig("-config", path, "-serverport", "3000")
+	require.NoError(t, err)
+	require.Equal(t, 3000, config.Server.Port)
+
+	t.Setenv("PCBOOK_CONFIG", path)
+	config, err = testLoadConfig("-serverport", "4000")
+	require.NoError(t, err)
+	require.Equal(t, 4000, config.Server.Port)
+	require.Equal(t, time.Minute, config.Server.ShutdownGrace)
+}
+
+func TestLoadConfigEmptyFile(t *testing.T) {
+	t.Setenv("PCBOOK_AUTH_JWT_SECRET", testJWTSecret)
+	t.Setenv("PCBOOK_STORAGE_AUDIT_KEY", testAuditKey)
+
+	config, err := testLoadConfig("-config", writeConfigFile(t, ""))
+	require.NoError(t, err)
+	require.Equal(t, defaultConfig().Server, config.Server)
+	require.Equal(t, testJWTSecret, config.Auth.JWTSecret)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := testLoadConfig()
+	require.ErrorContains(t, err, "auth.jwt_key or auth.jwt_secret is needed")
+	require.ErrorContains(t, err, "storage.audit_key needs at least 16 characters")
+
+	_, err = testLoadConfig("-config", filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorContains(t, err, "cant read config")
+
+	_, err = testLoadConfig("-config", writeConfigFile(t, "server:\n  prot: 8080\n"))
+	require.ErrorContains(t, err, "field prot not found")
+
+	_, err = testLoadConfig("-unknown")
+	require.ErrorContains(t, err, "flag provided but not defined")
+
+	t.Setenv("PCBOOK_AUTH_JWT_SECRET", testJWTSecret)
+	t.Setenv("PCBOOK_STORAGE_AUDIT_KEY", testAuditKey)
+	t.Setenv("PCBOOK_SERVER_SHUTDOWN_GRACE", "soon")
+	_, err = testLoadConfig("-serverport", "http")
+	require.ErrorContains(t, err, "PCBOOK_SERVER_SHUTDOWN_GRACE: expect a duration such as 30s")
+	require.ErrorContains(t, err, `-serverport: expect a number, got "http"`)
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	require.Empty(t, validConfig().validate())
+
+	testCases := []struct {
+		name    string
+		change  func(c *Config)
+		problem string
+	}{
+		{
+			name:    "port",
+			change:  func(c *Config) { c.Server.Port = 70000 },
+			problem: "server.port 70000 is not a TCP port",
+		},
+		{
+			name: "missing cert",
+			change: func(c *Config) {
+				c.Server.TLS = true
+				c.Server.CertFile = "missing.pem"
+				c.Server.KeyFile = "config.go"
+				c.Server.CAFile = "config.go"
+			},
+			problem: "server.cert_file: stat missing.pem",
+		},
+		{
+			name:    "client auth",
+			change:  func(c *Config) { c.Server.ClientAuth = "maybe" },
+			problem: `server.client_auth "maybe" is not require or if_given`,
+		},
+		{
+			name:    "shutdown grace",
+			change:  func(c *Config) { c.Server.ShutdownGrace = -time.Second },
+			problem: "server.shutdown_grace must not be negative",
+		},
+		{
+			name:    "read header timeout",
+			change:  func(c *Config) { c.Server.ReadHeaderTimeout = 0 },
+			problem: "server.read_header_timeout must be positive",
+		},
+		{
+			name:    "idle timeout",
+			change:  func(c *Config) { c.Server.IdleTimeout = 0 },
+			problem: "server.idle_timeout must be positive",
+		},
+		{
+			name:    "metrics address",
+			change:  func(c *Config) { c.Server.MetricsAddress = "9090" },
+			problem: `server.metrics_address "9090" is not a host:port`,
+		},
+		{
+			name:    "metrics on the public port",
+			change:  func(c *Config) { c.Server.MetricsAddress = ":8080" },
+			problem: "server.metrics_address must not use the public port 8080",
+		},
+		{
+			name:    "no JWT secret",
+			change:  func(c *Config) { c.Auth.JWTSecret = "" },
+			problem: "auth.jwt_key or auth.jwt_secret is needed",
+		},
+		{
+			name:    "placeholder JWT secret",
+			change:  func(c *Config) { c.Auth.JWTSecret = "Need to generate key" },
+			problem: "auth.jwt_secret is a placeholder",
+		},
+		{
+			name:    "example JWT secret",
+			change:  func(c *Config) { c.Auth.JWTSecret = "change-me-to-a-long-random-secret" },
+			problem: "auth.jwt_secret is a placeholder",
+		},
+		{
+			name:    "short JWT secret",
+			change:  func(c *Config) { c.Auth.JWTSecret = "short" },
+			problem: "auth.jwt_secret needs at least 16 characters",
+		},
+		{
+			name: "JWT key id",
+			change: func(c *Config) {
+				c.Auth.JWTKey = "../../cert/jwt-key.pem"
+				c.Auth.JWTKeyID = ""
+			},
+			problem: "auth.jwt_key_id is needed with auth.jwt_key",
+		},
+		{
+			name:    "token duration",
+			change:  func(c *Config) { c.Auth.TokenDuration = 0 },
+			problem: "auth.token_duration must be positive",
+		},
+		{
+			name:    "refresh token duration",
+			change:  func(c *Config) { c.Auth.RefreshTokenDuration = c.Auth.TokenDuration },
+			problem: "auth.refresh_token_duration must be longer than auth.token_duration",
+		},
+		{
+			name:    "policy file",
+			change:  func(c *Config) { c.Auth.PolicyFile = "" },
+			problem: "auth.policy_file is missing",
+		},
+		{
+			name:    "OIDC issuer",
+			change:  func(c *Config) { c.OIDC.IssuerURL = "accounts.pcbook.com" },
+			problem: `oidc.issuer_url "accounts.pcbook.com" is not an absolute URL`,
+		},
+		{
+			name: "OIDC redirect",
+			change: func(c *Config) {
+				c.OIDC.IssuerURL = "https://accounts.pcbook.com"
+				c.OIDC.RedirectURL = "/v1/auth/oidc/callback"
+			},
+			problem: `oidc.redirect_url "/v1/auth/oidc/callback" is not an absolute URL`,
+		},
+		{
+			name: "OIDC client id",
+			change: func(c *Config) {
+				c.OIDC.IssuerURL = "https://accounts.pcbook.com"
+				c.OIDC.ClientID = ""
+			},
+			problem: "oidc.client_id is needed with oidc.issuer_url",
+		},
+		{
+			name: "OIDC role",
+			change: func(c *Config) {
+				c.OIDC.Roles = oidcRoles{{Group: "staff", Role: userRole}, {Group: "admins", Role: "root"}}
+			},
+			problem: `oidc.roles[1] has unknown role "root"`,
+		},
+		{
+			name:    "OIDC default role",
+			change:  func(c *Config) { c.OIDC.DefaultRole = "guest" },
+			problem: `oidc.default_role "guest" is unknown`,
+		},
+		{
+			name:    "image folder",
+			change:  func(c *Config) { c.Storage.ImageFolder = "" },
+			problem: "storage.image_folder is missing",
+		},
+		{
+			name:    "audit log",
+			change:  func(c *Config) { c.Storage.AuditLog = "" },
+			problem: "storage.audit_log is missing",
+		},
+		{
+			name:    "audit key",
+			change:  func(c *Config) { c.Storage.AuditKey = "short" },
+			problem: "storage.audit_key needs at least 16 characters",
+		},
+		{
+			name:    "trace exporter",
+			change:  func(c *Config) { c.Tracing.Exporter = "jaeger" },
+			problem: `tracing.exporter "jaeger" is unknown`,
+		},
+		{
+			name:    "sample ratio",
+			change:  func(c *Config) { c.Tracing.SampleRatio = 2 },
+			problem: "tracing.sample_ratio must be between 0 and 1",
+		},
+		{
+			name:    "log format",
+			change:  func(c *Config) { c.Log.Format = "xml" },
+			problem: `log.format "xml" is unknown`,
+		},
+		{
+			name: "rate limit method",
+			change: func(c *Config) {
+				c.RateLimit.Methods = methodRateLimits{{Method: "CreateLaptop", Rate: 1, Burst: 1}}
+			},
+			problem: `rate_limit.methods[0] "CreateLaptop" is not a full method, /package.Service/* or *`,
+		},
+		{
+			name: "rate limit twice",
+			change: func(c *Config) {
+				c.RateLimit.Methods = methodRateLimits{{Method: "*", Rate: 1, Burst: 1}, {Method: "*", Rate: 2, Burst: 2}}
+			},
+			problem: "rate_limit.methods[1] * is listed twice",
+		},
+		{
+			name: "rate limit rate",
+			change: func(c *Config) {
+				c.RateLimit.Methods = methodRateLimits{{Method: "/pb.LaptopService/*", Rate: 0, Burst: 1}}
+			},
+			problem: "rate_limit.methods[0] needs a positive rate and burst",
+		},
+		{
+			name: "rate limit burst",
+			change: func(c *Config) {
+				c.RateLimit.Methods = methodRateLimits{{Method: "/pb.LaptopService/*", Rate: 1, Burst: 0}}
+			},
+			problem: "rate_limit.methods[0] needs a positive rate and burst",
+		},
+		{
+			name:    "peer rate",
+			change:  func(c *Config) { c.RateLimit.PeerRate = -1 },
+			problem: "rate_limit.peer_rate must be 0, or positive with a positive rate_limit.peer_burst",
+		},
+		{
+			name:    "peer burst",
+			change:  func(c *Config) { c.RateLimit.PeerBurst = 0 },
+			problem: "rate_limit.peer_rate must be 0, or positive with a positive rate_limit.peer_burst",
+		},
+		{
+			name:    "max streams",
+			change:  func(c *Config) { c.RateLimit.MaxStreams = -1 },
+			problem: "rate_limit.max_streams must not be negative",
+		},
+		{
+			name:    "seed user password",
+			change:  func(c *Config) { c.SeedUsers = []SeedUser{{Username: "root", Role: superAdminRole}} },
+			problem: "seed_users[0] needs a username and a password",
+		},
+		{
+			name: "weak seed user password",
+			change: func(c *Config) {
+				c.SeedUsers = []SeedUser{{Username: "root1", Password: "root1", Role: superAdminRole}}
+			},
+			problem: "seed_users[0] root1: " + service.ErrWeakPassword.Error(),
+		},
+		{
+			name: "seed user twice",
+			change: func(c *Config) {
+				c.SeedUsers = []SeedUser{
+					{Username: "admin", Password: "correct-horse-battery", Role: adminRole},
+					{Username: "admin", Password: "staple-horse-battery", Role: adminRole},
+				}
+			},
+			problem: "seed_users[1] admin is listed twice",
+		},
+		{
+			name: "seed user role",
+			change: func(c *Config) {
+				c.SeedUsers = []SeedUser{{Username: "admin", Password: "correct-horse-battery", Role: "root"}}
+			},
+			problem: `seed_users[0] has unknown role "root"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := validConfig()
+			tc.change(config)
+			problems := config.validate()
+			require.Len(t, problems, 1, problems)
+			require.Contains(t, problems[0], tc.problem)
+		})
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	t.Parallel()
+
+	config := validConfig()
+	config.OIDC.ClientSecret = "oidc-client-secret"
+	config.SeedUsers = []SeedUser{{Username: "admin", Password: "correct-horse-battery", Role: adminRole}}
+
+	redacted := config.Redacted()
+	for _, secret := range []string{testJWTSecret, testAuditKey, "oidc-client-secret", "correct-horse-battery"} {
+		require.NotContains(t, redacted, secret)
+	}
+	require.Contains(t, redacted, "jwt_secret: REDACTED")
+	require.Contains(t, redacted, "username: admin")
+	require.Contains(t, redacted, "port: 8080")
+
+	// the config itself keeps its secrets
+	require.Equal(t, testJWTSecret, config.Auth.JWTSecret)
+	require.Equal(t, "correct-horse-battery", config.SeedUsers[0].Password)
+}
+
+func TestMethodRateLimitsUnmarshalText(t *testing.T) {
+	t.Parallel()
+
+	var limits methodRateLimits
+	require.NoError(t, limits.UnmarshalText([]byte("*=50:100, /pb.LaptopService/CreateLaptop=0.5:10")))
+	require.Equal(t, methodRateLimits{
+		{Method: "*", Rate: 50, Burst: 100},
+		{Method: "/pb.LaptopService/CreateLaptop", Rate: 0.5, Burst: 10},
+	}, limits)
+	require.Equal(t, "*=50:100,/pb.LaptopService/CreateLaptop=0.5:10", limits.String())
+
+	require.NoError(t, limits.UnmarshalText([]byte("")))
+	require.Empty(t, limits)
+
+	for text, message := range map[string]string{
+		"*":         "expect method=rate:burst",
+		"*=50":      "expect method=rate:burst",
+		"*=fast:10": "invalid rate",
+		"*=50:many": "invalid burst",
+		"*=50:1.5":  "invalid burst",
+	} {
+		err := limits.UnmarshalText([]byte(text))
+		require.ErrorContains(t, err, message, text)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	t.Parallel()
+
+	config := RateLimitConfig{
+		Methods:    methodRateLimits{{Method: "*", Rate: 50, Burst: 100}},
+		PeerRate:   100,
+		PeerBurst:  200,
+		MaxStreams: 10,
+	}
+	require.Equal(t, service.RateLimits{
+		Methods:    map[string]service.RateLimit{"*": {Rate: 50, Burst: 100}},
+		Peer:       service.RateLimit{Rate: 100, Burst: 200},
+		MaxStreams: 10,
+	}, config.RateLimits())
+
+	require.Equal(t, service.DefaultRateLimits, defaultConfig().RateLimit.RateLimits())
+}
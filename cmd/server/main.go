@@ -4,68 +4,147 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
 	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/cors"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 const (
-	imageFolder       = "./img"
-	secretKey         = "Need to generate key"
-	tokenDuration     = time.Hour
-	adminRole         = "admin"
-	userRole          = "user"
-	laptopServicePath = "/pb.LaptopService/"
-	serverCert        = "cert/server-cert.pem"
-	serverKey         = "cert/server-key.pem"
-	caCert            = "cert/ca-cert.pem"
+	superAdminRole = service.SuperAdminRole
+	adminRole      = "admin"
+	userRole       = "user"
+	serviceName    = "pcbook-server"
+	jwksPath       = "/.well-known/jwks.json"
+	metricsPath    = "/metrics"
+
+	healthCheckInterval = 10 * time.Second
 )
 
-func seedUsers(userStore service.UserStore) error {
-	err := createUsers(userStore, "admin1", "admin1", adminRole)
-	if err != nil {
-		return err
+// roles SetUserRole and the seed users may use.
+var roles = []string{superAdminRole, adminRole, userRole}
+
+func isRole(role string) bool {
+	for _, known := range roles {
+		if known == role {
+			return true
+		}
+	}
+	return false
+}
+
+// fatal logs the error of a startup step and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func seedUsers(userStore service.UserStore, users []SeedUser) error {
+	for _, seed := range users {
+		err := createUsers(userStore, seed.Username, seed.Password, seed.Role, seed.Organization)
+		if err != nil {
+			return err
+		}
 	}
-	return createUsers(userStore, "user1", "user1", userRole)
+	return nil
 }
 
 func createUsers(userStore service.UserStore,
-	username, rawPw, role string) error {
+	username, rawPw, role, organization string) error {
 
 	user, err := service.NewUser(username, rawPw, role)
 	if err != nil {
 		return err
 	}
+	user.Organization = organization
 	return userStore.Save(user)
 }
 
-func accessibleRoles() map[string][]string {
-	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {adminRole},
-		laptopServicePath + "UploadImage":  {adminRole},
-		laptopServicePath + "RateLaptop":   {adminRole, userRole},
+// newJWTManager signs with the PEM key file when given, and falls back to
+// the HS256 secret otherwise. The previous public keys stay accepted during
+// a rotation.
+func newJWTManager(config AuthConfig) (*service.JWTManager, error) {
+	if len(config.JWTKey) == 0 {
+		slog.Warn("no JWT signing key, signing tokens with the HS256 secret")
+		return service.NewJWTManager(config.JWTSecret, config.TokenDuration, config.RefreshTokenDuration), nil
 	}
+
+	signingKey, err := service.LoadSigningKey(config.JWTKey, config.JWTKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var verificationKeys []*service.VerificationKey
+	for _, verifyKey := range config.JWTVerifyKeys {
+		key, err := service.LoadVerificationKey(verifyKey.Path, verifyKey.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		verificationKeys = append(verificationKeys, key)
+	}
+
+	return service.NewAsymmetricJWTManager(signingKey, verificationKeys, config.TokenDuration, config.RefreshTokenDuration), nil
 }
 
-func loadTLSCredentials() (credentials.TransportCredentials, error) {
-	serverCert, err := tls.LoadX509KeyPair(serverCert,
-		secretKey)
+// newOIDCProvider returns nil when no issuer is given.
+func newOIDCProvider(config OIDCConfig) (*service.OIDCProvider, error) {
+	if len(config.IssuerURL) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	return service.NewOIDCProvider(ctx, service.OIDCConfig{
+		IssuerURL:     config.IssuerURL,
+		ClientID:      config.ClientID,
+		ClientSecret:  config.ClientSecret,
+		RedirectURL:   config.RedirectURL,
+		UsernameClaim: config.UsernameClaim,
+		GroupsClaim:   config.GroupsClaim,
+		Roles:         config.Roles,
+		DefaultRole:   config.DefaultRole,
+	})
+}
+
+// loadTLSConfig serves gRPC and REST over TLS. A client certificate
+// signed by the CA is required, or with client_auth if_given only verified
+// when sent. It authenticates the callers mapped by the policy; the others
+// need a token or an API key, browsers included.
+func loadTLSConfig(config ServerConfig) (*tls.Config, error) {
+	serverCert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
 	if err != nil {
 		return nil, err
 	}
 
-	cert, err := os.ReadFile(caCert)
+	cert, err := os.ReadFile(config.CAFile)
 	if err != nil {
 		return nil, err
 	}
@@ -77,115 +156,633 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 		return nil, fmt.Errorf("fail server cert")
 	}
 
-	config := &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
+	clientAuth := tls.RequireAndVerifyClientCert
+	if config.ClientAuth == clientAuthIfGiven {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
 
-		ClientAuth: tls.RequireAndVerifyClientCert, // mutual TLS
-		ClientCAs:  certPool,                       // mutual TLS
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		NextProtos:   []string{"h2", "http/1.1"},
 
-		// ClientAuth:   tls.NoClientCert, // Client no need to auth
+		ClientAuth: clientAuth, // mutual TLS
+		ClientCAs:  certPool,   // mutual TLS
 	}
 
-	return credentials.NewTLS(config), nil
+	return tlsConfig, nil
 }
 
-func runGRPCServer(authServer pb.AuthServiceServer,
+// newGRPCServer registers the services behind the tracing, logging,
+// metrics, audit and auth interceptors. With gateway, it trusts the client
+// address forwarded by the REST gateway and must only be reachable by it.
+func newGRPCServer(authServer pb.AuthServiceServer,
 	laptopServer pb.LaptopServiceServer,
+	userAdminServer pb.UserAdminServiceServer,
+	apiKeyServer pb.APIKeyServiceServer,
+	auditServer pb.AuditServiceServer,
 	jwtManager *service.JWTManager,
-	enableTLS bool, listener net.Listener) error {
-
-	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles())
-
-	serverOTPs := []grpc.ServerOption{
-		grpc.UnaryInterceptor(interceptor.Unary()),
-		grpc.StreamInterceptor(interceptor.Stream()),
+	userStore service.UserStore,
+	revocationStore service.RevocationStore,
+	apiKeyStore service.APIKeyStore,
+	policy *service.PolicyManager,
+	auditLog service.AuditLog,
+	healthServer healthpb.HealthServer,
+	logging *service.LoggingInterceptor,
+	metrics *service.MetricsInterceptor,
+	rateLimiter *service.RateLimiter,
+	gateway bool) (*grpc.Server, error) {
+
+	interceptor := service.NewAuthInterceptor(jwtManager, userStore, revocationStore, apiKeyStore, policy)
+	auditInterceptor := service.NewAuditInterceptor(auditLog, service.DefaultAuditedMethods)
+
+	// the tracing, logging, metrics and audit come first to also record the
+	// calls the auth or the rate limits reject. The peer IP limit protects
+	// the auth from floods of bad tokens, the per caller limits need the
+	// caller found by the auth.
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		otelgrpc.UnaryServerInterceptor(),
+		logging.Unary(),
+		metrics.Unary(),
+		auditInterceptor.Unary(),
+		rateLimiter.PeerUnary(),
+		interceptor.Unary(),
+		rateLimiter.Unary(),
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		otelgrpc.StreamServerInterceptor(),
+		logging.Stream(),
+		metrics.Stream(),
+		auditInterceptor.Stream(),
+		rateLimiter.PeerStream(),
+		interceptor.Stream(),
+		rateLimiter.Stream(),
+	}
+	if gateway {
+		gatewayPeer := service.GatewayPeerInterceptor{}
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{gatewayPeer.Unary()}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{gatewayPeer.Stream()}, streamInterceptors...)
 	}
 
-	if enableTLS {
-		loadTLSCredentials, err := loadTLSCredentials()
-		if err != nil {
-			log.Fatal(err)
-		}
-		serverOTPs = append(serverOTPs, grpc.Creds(loadTLSCredentials))
+	serverOTPs := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
 	}
 
 	grpcServer := grpc.NewServer(serverOTPs...)
 
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
 	pb.RegisterAuthServiceServer(grpcServer, authServer)
+	pb.RegisterUserAdminServiceServer(grpcServer, userAdminServer)
+	pb.RegisterAPIKeyServiceServer(grpcServer, apiKeyServer)
+	pb.RegisterAuditServiceServer(grpcServer, auditServer)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
 	reflection.Register(grpcServer)
 
-	log.Println("starting GRPC server")
+	rules, err := service.ProtoAccessRules(grpcServer.GetServiceInfo())
+	if err != nil {
+		return nil, err
+	}
 
-	return grpcServer.Serve(listener)
+	err = policy.SetProtoRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	err = policy.RequireMethods(registeredMethods(grpcServer))
+	if err != nil {
+		return nil, err
+	}
+
+	return grpcServer, nil
 }
 
-func runRESTServer(authServer pb.AuthServiceServer,
-	laptopServer pb.LaptopServiceServer,
+// newServer serves gRPC, gRPC-Web and REST on one port. gRPC is told apart
+// by the HTTP/2 gRPC content type, gRPC-Web by its own. Without TLS, HTTP/2
+// is spoken in clear text (h2c). Browsers may call gRPC-Web and REST from
+// the allowed origins. Every call is counted by calls. REST requests start
+// a span, or continue the trace of their traceparent header.
+func newServer(grpcServer *grpc.Server, restHandler http.Handler,
+	allowOrigin func(origin string) bool,
+	calls *activeCalls,
+	config ServerConfig) (*http.Server, error) {
+
+	grpcWebServer := grpcweb.WrapServer(grpcServer, grpcweb.WithOriginFunc(allowOrigin))
+	restHandler = otelhttp.NewHandler(restHandler, "REST",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/healthz" && r.URL.Path != "/readyz"
+		}),
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return operation + " " + r.Method
+		}))
+	restHandler = cors.New(cors.Options{
+		AllowOriginFunc: allowOrigin,
+		AllowedMethods:  []string{http.MethodGet, http.MethodPost},
+		AllowedHeaders:  []string{"Authorization", "X-Api-Key", "X-Request-Id", "Content-Type"},
+		ExposedHeaders:  []string{"X-Request-Id"},
+	}).Handler(withRequestID(restHandler))
+
+	handler := calls.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if grpcWebServer.IsGrpcWebRequest(r) || grpcWebServer.IsAcceptableGrpcCorsRequest(r) {
+			grpcWebServer.ServeHTTP(w, r)
+			return
+		}
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		restHandler.ServeHTTP(w, r)
+	}))
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	if !config.TLS {
+		// registered with the server so that Shutdown also sends GOAWAY
+		// on the h2c connections
+		h2Server := &http2.Server{IdleTimeout: config.IdleTimeout}
+		server.Handler = h2c.NewHandler(handler, h2Server)
+		err := http2.ConfigureServer(server, h2Server)
+		if err != nil {
+			return nil, err
+		}
+		return server, nil
+	}
+
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	server.TLSConfig = tlsConfig
+
+	return server, nil
+}
+
+func runServer(server *http.Server, enableTLS bool, listener net.Listener) error {
+	slog.Info("serving GRPC and REST", "address", listener.Addr().String(), "tls", enableTLS)
+
+	var err error
+	if enableTLS {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// activeCalls counts the requests and streams being served. The h2c
+// connections are hijacked from the HTTP server, Shutdown cant wait for
+// their calls.
+type activeCalls struct {
+	count atomic.Int64
+}
+
+func (c *activeCalls) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.count.Add(1)
+		defer c.count.Add(-1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// wait returns when no call is left or ctx is done.
+func (c *activeCalls) wait(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.count.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// shutdownOnSignal drains the server on SIGINT or SIGTERM. done is closed
+// once the servers are stopped.
+func shutdownOnSignal(server *http.Server,
+	grpcServer, gatewayServer *grpc.Server,
+	healthChecker *service.HealthChecker,
+	calls *activeCalls,
+	grace time.Duration) (done <-chan struct{}) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+
+	go func() {
+		sig := <-signals
+		slog.Info("draining", "signal", sig.String(), "grace", grace)
+		drain(server, grpcServer, gatewayServer, healthChecker, calls, grace)
+		close(stopped)
+	}()
+
+	return stopped
+}
+
+// drain turns the health NOT_SERVING, refuses new connections and calls and
+// gives the running ones the grace period to finish, then stops the rest.
+func drain(server *http.Server,
+	grpcServer, gatewayServer *grpc.Server,
+	healthChecker *service.HealthChecker,
+	calls *activeCalls,
+	grace time.Duration) {
+
+	healthChecker.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = calls.wait(ctx)
+	}
+	if err != nil {
+		slog.Warn("grace period is over, stopping the calls left", "calls", calls.count.Load())
+		server.Close()
+	}
+
+	// Stop also ends the calls served on hijacked connections, the
+	// gateway server got its calls from the REST requests, done by now
+	grpcServer.Stop()
+	gatewayServer.Stop()
+}
+
+func registeredMethods(grpcServer *grpc.Server) []string {
+	var methods []string
+	for name, info := range grpcServer.GetServiceInfo() {
+		for _, method := range info.Methods {
+			methods = append(methods, fmt.Sprintf("/%v/%v", name, method.Name))
+		}
+	}
+	return methods
+}
+
+// reloadPolicyOnSIGHUP reads the policy file again on every SIGHUP.
+func reloadPolicyOnSIGHUP(policy *service.PolicyManager) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			err := policy.Reload()
+			if err != nil {
+				slog.Error("keep the current policy, cant reload", "error", err)
+				continue
+			}
+			slog.Info("policy reloaded")
+		}
+	}()
+}
+
+// newRESTHandler returns the gateway. It calls grpcServer through an in
+// memory connection, so REST requests go through the same interceptors as
+// gRPC ones: the Authorization and X-Api-Key headers become metadata.
+func newRESTHandler(grpcServer *grpc.Server,
 	jwtManager *service.JWTManager,
-	enableTLS bool, listener net.Listener) error {
+	healthChecker *service.HealthChecker) (http.Handler, error) {
 
-	mux := runtime.NewServeMux()
+	inProcess := bufconn.Listen(1024 * 1024)
+	go func() {
+		err := grpcServer.Serve(inProcess)
+		if err != nil {
+			slog.Error("in process GRPC server stopped", "error", err)
+		}
+	}()
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return inProcess.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// passes the trace of the REST request on to the gRPC call
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()))
+	if err != nil {
+		return nil, err
+	}
+
+	mux := runtime.NewServeMux(runtime.WithIncomingHeaderMatcher(gatewayHeaderMatcher))
 	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
-	defer cancel()
 
-	err := pb.RegisterAuthServiceHandlerServer(ctx, mux, authServer)
+	err = pb.RegisterAuthServiceHandler(ctx, mux, conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = pb.RegisterLaptopServiceHandlerServer(ctx, mux, laptopServer)
+	err = pb.RegisterLaptopServiceHandler(ctx, mux, conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Println("starting REST server")
-	if enableTLS {
-		return http.ServeTLS(listener, mux, serverCert, serverKey)
+	err = service.RegisterLaptopGatewayHandlers(mux, pb.NewLaptopServiceClient(conn))
+	if err != nil {
+		return nil, err
+	}
+
+	err = pb.RegisterUserAdminServiceHandler(ctx, mux, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pb.RegisterAPIKeyServiceHandler(ctx, mux, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pb.RegisterAuditServiceHandler(ctx, mux, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// other services verify pcbook tokens with these keys
+	err = mux.HandlePath(http.MethodGet, jwksPath,
+		func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "max-age=300")
+			err := json.NewEncoder(w).Encode(jwtManager.JWKS())
+			if err != nil {
+				slog.Error("cant write JWKS", "error", err)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// liveness: the process answers
+	err = mux.HandlePath(http.MethodGet, "/healthz",
+		func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+			writeHealth(w, http.StatusOK, nil)
+		})
+	if err != nil {
+		return nil, err
 	}
 
-	return http.Serve(listener, mux)
+	// readiness: the stores work and the server is not draining
+	err = mux.HandlePath(http.MethodGet, "/readyz",
+		func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+			ready, failures := healthChecker.Ready()
+			if !ready {
+				writeHealth(w, http.StatusServiceUnavailable, failures)
+				return
+			}
+			writeHealth(w, http.StatusOK, nil)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return mux, nil
+}
+
+// newMetricsRegistry gathers the call and store metrics with those of the
+// Go runtime and the process.
+func newMetricsRegistry(laptopStore *service.InMemoryLaptopStore,
+	imageStore *service.DiskImageStore,
+	ratingStore *service.InMemoryRatingStore) (*prometheus.Registry, *service.MetricsInterceptor, error) {
+	registry := prometheus.NewRegistry()
+
+	metrics, err := service.NewMetricsInterceptor(registry)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	others := append(service.NewStoreMetrics(laptopStore, imageStore, ratingStore),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	for _, collector := range others {
+		err = registry.Register(collector)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return registry, metrics, nil
+}
+
+// newMetricsServer serves the Prometheus metrics without authentication,
+// on an address of its own kept off the public port.
+func newMetricsServer(metrics prometheus.Gatherer, config ServerConfig) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+func writeHealth(w http.ResponseWriter, code int, failures map[string]string) {
+	res := struct {
+		Status   string            `json:"status"`
+		Failures map[string]string `json:"failures,omitempty"`
+	}{Status: "ok", Failures: failures}
+	if code != http.StatusOK {
+		res.Status = "unavailable"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		slog.Error("cant write health", "error", err)
+	}
+}
+
+// allowedOrigins matches the origins, such as https://shop.pcbook.com, or
+// any origin for "*".
+func allowedOrigins(origins []string) func(origin string) bool {
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return func(origin string) bool {
+		return allowed["*"] || allowed[origin]
+	}
+}
+
+// gatewayHeaderMatcher forwards the API key and request ID headers on top
+// of the default ones, Authorization among them.
+func gatewayHeaderMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, "X-Api-Key") {
+		return "x-api-key", true
+	}
+	if strings.EqualFold(key, service.RequestIDKey) {
+		return service.RequestIDKey, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// withRequestID gives every REST request a request ID, passed on to the
+// gRPC call and returned in the X-Request-Id header.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := service.RequestID(r.Header.Get(service.RequestIDKey))
+		r.Header.Set(service.RequestIDKey, id)
+		w.Header().Set(service.RequestIDKey, id)
+		handler.ServeHTTP(w, r)
+	})
 }
 
 func main() {
-	port := flag.String("serverport", "8080", "server port")
-	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
-	restServer := flag.Bool("rest", false, "enable REST instead of GRPC")
-	flag.Parse()
-	log.Printf("starting server on port: %v, TLS: %v", *port, *enableTLS)
+	config, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logger, err := service.NewLogger(os.Stderr, config.Log.Level, config.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	slog.Info("starting server", "config", config.Redacted())
+
+	shutdownTracing, err := service.SetupTracing(context.Background(), service.TracingConfig{
+		ServiceName:  serviceName,
+		Exporter:     config.Tracing.Exporter,
+		OTLPEndpoint: config.Tracing.OTLPEndpoint,
+		OTLPInsecure: config.Tracing.OTLPInsecure,
+		SampleRatio:  config.Tracing.SampleRatio,
+	})
+	if err != nil {
+		fatal("cant set up tracing", err)
+	}
 
 	userStore := service.NewInMemoryUserStore()
-	err := seedUsers(userStore)
+	err = seedUsers(userStore, config.SeedUsers)
 	if err != nil {
-		log.Fatal(err)
+		fatal("cant create seed users", err)
 	}
-	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
+	jwtManager, err := newJWTManager(config.Auth)
+	if err != nil {
+		fatal("cant create JWT manager", err)
+	}
+	revocationStore := service.NewInMemoryRevocationStore()
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+
+	policy, err := service.LoadPolicyManager(config.Auth.PolicyFile)
+	if err != nil {
+		fatal("cant load policy", err)
+	}
+	reloadPolicyOnSIGHUP(policy)
 
-	address := fmt.Sprintf(":%v", *port)
+	address := fmt.Sprintf(":%v", config.Server.Port)
 	lis, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatal(err)
+		fatal("cant listen", err)
 	}
 
 	laptopStore := service.NewInMemoryLaptopStore()
 	ratingStore := service.NewInMemoryRatingStore()
-	imageStore := service.NewDiskImageStore(imageFolder)
+	imageStore := service.NewDiskImageStore(config.Storage.ImageFolder)
 
-	authServer := service.NewAuthServer(userStore, jwtManager)
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	oidcProvider, err := newOIDCProvider(config.OIDC)
+	if err != nil {
+		fatal("cant set up OIDC", err)
+	}
 
-	if *restServer {
-		err = runRESTServer(authServer, laptopServer, jwtManager, *enableTLS, lis)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		err = runGRPCServer(authServer, laptopServer, jwtManager, *enableTLS, lis)
-		if err != nil {
-			log.Fatal(err)
+	loginLimiter := service.NewLoginLimiter(service.DefaultLoginLimits)
+	authServer := service.NewAuthServer(userStore, jwtManager, revocationStore, loginLimiter, oidcProvider)
+	laptopServer := service.NewLaptopServer(service.NewTracedLaptopStore(laptopStore),
+		service.NewTracedImageStore(imageStore),
+		service.NewTracedRatingStore(ratingStore))
+	tenantStore := service.NewInMemoryTenantStore()
+	userAdminServer := service.NewUserAdminServer(userStore, tenantStore, loginLimiter, roles)
+	apiKeyServer := service.NewAPIKeyServer(apiKeyStore)
+
+	auditLog, err := service.NewFileAuditLog(config.Storage.AuditLog, []byte(config.Storage.AuditKey))
+	if err != nil {
+		fatal("cant open audit log", err)
+	}
+	auditServer := service.NewAuditServer(auditLog)
+
+	services := []string{
+		pb.LaptopService_ServiceDesc.ServiceName,
+		pb.AuthService_ServiceDesc.ServiceName,
+		pb.UserAdminService_ServiceDesc.ServiceName,
+		pb.APIKeyService_ServiceDesc.ServiceName,
+		pb.AuditService_ServiceDesc.ServiceName,
+	}
+	healthChecker := service.NewHealthChecker(services, []service.HealthCheck{
+		{Name: "image_store", Services: services[:1], Check: imageStore.Check},
+		{Name: "audit_log", Services: services, Check: auditLog.Check},
+	})
+	go healthChecker.Run(context.Background(), healthCheckInterval)
+
+	registry, metrics, err := newMetricsRegistry(laptopStore, imageStore, ratingStore)
+	if err != nil {
+		fatal("cant register metrics", err)
+	}
+	metricsListener, err := net.Listen("tcp", config.Server.MetricsAddress)
+	if err != nil {
+		fatal("cant listen for metrics", err)
+	}
+	metricsServer := newMetricsServer(registry, config.Server)
+	go func() {
+		slog.Info("serving metrics", "address", metricsListener.Addr().String(), "path", metricsPath)
+		err := metricsServer.Serve(metricsListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "error", err)
 		}
+	}()
+
+	logging := service.NewLoggingInterceptor(logger)
+	rateLimiter := service.NewRateLimiter(config.RateLimit.RateLimits())
+
+	// both servers share the services and their stores, the second one is
+	// only called in memory by the gateway
+	grpcServer, err := newGRPCServer(authServer, laptopServer, userAdminServer, apiKeyServer, auditServer,
+		jwtManager, userStore, revocationStore, apiKeyStore, policy, auditLog, healthChecker.Server(), logging, metrics, rateLimiter, false)
+	if err != nil {
+		fatal("cant create GRPC server", err)
+	}
+	gatewayServer, err := newGRPCServer(authServer, laptopServer, userAdminServer, apiKeyServer, auditServer,
+		jwtManager, userStore, revocationStore, apiKeyStore, policy, auditLog, healthChecker.Server(), logging, metrics, rateLimiter, true)
+	if err != nil {
+		fatal("cant create gateway GRPC server", err)
+	}
+
+	restHandler, err := newRESTHandler(gatewayServer, jwtManager, healthChecker)
+	if err != nil {
+		fatal("cant create REST gateway", err)
+	}
+
+	calls := &activeCalls{}
+	server, err := newServer(grpcServer, restHandler, allowedOrigins(config.Server.CORSOrigins), calls, config.Server)
+	if err != nil {
+		fatal("cant create server", err)
+	}
+	stopped := shutdownOnSignal(server, grpcServer, gatewayServer, healthChecker, calls, config.Server.ShutdownGrace)
+
+	err = runServer(server, config.Server.TLS, lis)
+	if err != nil {
+		fatal("server failed", err)
 	}
+	<-stopped
+	metricsServer.Close()
 
+	// the audit records are all written, sync them to disk
+	err = auditLog.Close()
+	if err != nil {
+		slog.Error("cant close audit log", "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = shutdownTracing(ctx)
+	if err != nil {
+		slog.Error("cant flush the spans", "error", err)
+	}
+	slog.Info("server stopped")
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/sample"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testServers are the gRPC servers and the REST gateway main wires up,
+// with a super admin able to call everything.
+type testServers struct {
+	grpcServer    *grpc.Server
+	gatewayServer *grpc.Server
+	rest          http.Handler
+	healthChecker *service.HealthChecker
+	registry      *prometheus.Registry
+	jwtManager    *service.JWTManager
+	userStore     service.UserStore
+	adminToken    string
+}
+
+func newTestServers(t *testing.T, rateLimits service.RateLimits) *testServers {
+	t.Helper()
+
+	s := &testServers{
+		jwtManager: service.NewJWTManager("test-secret-long-enough", time.Minute, time.Hour),
+		userStore:  service.NewInMemoryUserStore(),
+	}
+	require.NoError(t, createUsers(s.userStore, "root1", "root-long-secret", superAdminRole, ""))
+	root, err := s.userStore.Find("root1")
+	require.NoError(t, err)
+	s.adminToken, err = s.jwtManager.Generate(root)
+	require.NoError(t, err)
+
+	revocationStore := service.NewInMemoryRevocationStore()
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	policy, err := service.LoadPolicyManager("../../policy.yaml")
+	require.NoError(t, err)
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	loginLimiter := service.NewLoginLimiter(service.DefaultLoginLimits)
+	authServer := service.NewAuthServer(s.userStore, s.jwtManager, revocationStore, loginLimiter, nil)
+	imageStore := service.NewDiskImageStore(t.TempDir())
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	userAdminServer := service.NewUserAdminServer(s.userStore, service.NewInMemoryTenantStore(), loginLimiter, roles)
+	apiKeyServer := service.NewAPIKeyServer(apiKeyStore)
+
+	auditLog, err := service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), []byte("test-audit-key-long-enough"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		auditLog.Close()
+	})
+	auditServer := service.NewAuditServer(auditLog)
+
+	s.healthChecker = service.NewHealthChecker([]string{pb.LaptopService_ServiceDesc.ServiceName}, nil)
+	var metrics *service.MetricsInterceptor
+	s.registry, metrics, err = newMetricsRegistry(laptopStore, imageStore, ratingStore)
+	require.NoError(t, err)
+
+	logger, err := service.NewLogger(&bytes.Buffer{}, slog.LevelError, "text")
+	require.NoError(t, err)
+	logging := service.NewLoggingInterceptor(logger)
+	rateLimiter := service.NewRateLimiter(rateLimits)
+
+	s.grpcServer, err = newGRPCServer(authServer, laptopServer, userAdminServer, apiKeyServer, auditServer,
+		s.jwtManager, s.userStore, revocationStore, apiKeyStore, policy, auditLog, s.healthChecker.Server(), logging, metrics, rateLimiter, false)
+	require.NoError(t, err)
+	s.gatewayServer, err = newGRPCServer(authServer, laptopServer, userAdminServer, apiKeyServer, auditServer,
+		s.jwtManager, s.userStore, revocationStore, apiKeyStore, policy, auditLog, s.healthChecker.Server(), logging, metrics, rateLimiter, true)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.grpcServer.Stop()
+		s.gatewayServer.Stop()
+	})
+
+	s.rest, err = newRESTHandler(s.gatewayServer, s.jwtManager, s.healthChecker)
+	require.NoError(t, err)
+	return s
+}
+
+func TestRESTNeedsToken(t *testing.T) {
+	t.Parallel()
+
+	servers := newTestServers(t, service.RateLimits{})
+
+	createLaptop := func(header http.Header) *httptest.ResponseRecorder {
+		body, err := (&runtime.JSONPb{}).Marshal(&pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/v1/laptop/create", bytes.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rec := httptest.NewRecorder()
+		servers.rest.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusUnauthorized, createLaptop(nil).Code)
+	require.Equal(t, http.StatusUnauthorized, createLaptop(http.Header{"Authorization": {"forged-token"}}).Code)
+
+	rec := createLaptop(http.Header{"Authorization": {servers.adminToken}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	created := &pb.CreateLaptopResponse{}
+	require.NoError(t, (&runtime.JSONPb{}).Unmarshal(rec.Body.Bytes(), created))
+	require.NotEmpty(t, created.GetId())
+}
+
+// serve starts the one-port server of main without TLS and returns its
+// address.
+func (s *testServers) serve(t *testing.T, config ServerConfig, calls *activeCalls) (*http.Server, string) {
+	t.Helper()
+
+	server, err := newServer(s.grpcServer, s.rest, allowedOrigins(config.CORSOrigins), calls, config)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return server, listener.Addr().String()
+}
+
+func TestServerRoutesByContentType(t *testing.T) {
+	t.Parallel()
+
+	servers := newTestServers(t, service.RateLimits{})
+	_, address := servers.serve(t, defaultConfig().Server, &activeCalls{})
+
+	// gRPC
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	res, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.GetStatus())
+
+	// REST over HTTP/1.1 and over HTTP/2 without the gRPC content type
+	for proto, client := range map[int]*http.Client{1: http.DefaultClient, 2: h2cClient()} {
+		resp, err := client.Get("http://" + address + "/healthz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, proto, resp.ProtoMajor)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, resp.Header.Get("Content-Type"), "application/json")
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		origins []string
+		allowed map[string]bool
+	}{
+		{
+			name:    "none",
+			origins: nil,
+			allowed: map[string]bool{"https://shop.pcbook.com": false, "": false},
+		},
+		{
+			name:    "any",
+			origins: []string{"*"},
+			allowed: map[string]bool{"https://shop.pcbook.com": true, "http://evil.com": true},
+		},
+		{
+			name:    "list",
+			origins: []string{"https://shop.pcbook.com/", "http://localhost:3000"},
+			allowed: map[string]bool{
+				"https://shop.pcbook.com":  true,
+				"http://localhost:3000":    true,
+				"http://shop.pcbook.com":   false,
+				"https://evil.pcbook.com":  false,
+				"http://localhost:3000.io": false,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			allow := allowedOrigins(tc.origins)
+			for origin, allowed := range tc.allowed {
+				require.Equal(t, allowed, allow(origin), origin)
+			}
+		})
+	}
+}
+
+func TestServerBrowsers(t *testing.T) {
+	t.Parallel()
+
+	servers := newTestServers(t, service.RateLimits{})
+	config := defaultConfig().Server
+	config.CORSOrigins = []string{"https://shop.pcbook.com"}
+	server, err := newServer(servers.grpcServer, servers.rest, allowedOrigins(config.CORSOrigins), &activeCalls{}, config)
+	require.NoError(t, err)
+
+	serve := func(method string, path string, header http.Header, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("gRPC-Web", func(t *testing.T) {
+		t.Parallel()
+
+		// one uncompressed frame holding an empty HealthCheckRequest
+		frame := []byte{0, 0, 0, 0, 0}
+		rec := serve(http.MethodPost, "/grpc.health.v1.Health/Check", http.Header{
+			"Content-Type": {"application/grpc-web+proto"},
+			"Origin":       {"https://shop.pcbook.com"},
+		}, frame)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "application/grpc-web+proto", rec.Header().Get("Content-Type"))
+		require.Equal(t, "https://shop.pcbook.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		require.Contains(t, rec.Body.String(), "grpc-status: 0")
+	})
+
+	t.Run("gRPC-Web preflight", func(t *testing.T) {
+		t.Parallel()
+
+		preflight := func(origin string) *httptest.ResponseRecorder {
+			return serve(http.MethodOptions, "/grpc.health.v1.Health/Check", http.Header{
+				"Origin":                         {origin},
+				"Access-Control-Request-Method":  {http.MethodPost},
+				"Access-Control-Request-Headers": {"content-type,x-grpc-web"},
+			}, nil)
+		}
+
+		rec := preflight("https://shop.pcbook.com")
+		require.Equal(t, "https://shop.pcbook.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		require.Empty(t, preflight("https://evil.com").Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("REST preflight", func(t *testing.T) {
+		t.Parallel()
+
+		preflight := func(origin string) *httptest.ResponseRecorder {
+			return serve(http.MethodOptions, "/v1/laptop/create", http.Header{
+				"Origin":                         {origin},
+				"Access-Control-Request-Method":  {http.MethodPost},
+				"Access-Control-Request-Headers": {"authorization,content-type"},
+			}, nil)
+		}
+
+		rec := preflight("https://shop.pcbook.com")
+		require.Equal(t, "https://shop.pcbook.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		require.Contains(t, strings.ToLower(rec.Header().Get("Access-Control-Allow-Headers")), "authorization")
+		require.Empty(t, preflight("https://evil.com").Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+// h2cClient speaks HTTP/2 in clear text, its requests are served on the
+// connections hijacked from the HTTP server.
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+}
+
+func TestDrainWaitsForCalls(t *testing.T) {
+	t.Parallel()
+
+	servers := newTestServers(t, service.RateLimits{})
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	calls := &activeCalls{}
+	server, err := newServer(servers.grpcServer, slow, allowedOrigins(nil), calls, defaultConfig().Server)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := h2cClient().Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	drain(server, servers.grpcServer, servers.gatewayServer, servers.healthChecker, calls, 5*time.Second)
+	require.Zero(t, calls.count.Load())
+
+	res := <-results
+	require.NoError(t, res.err)
+	require.Equal(t, "done", res.body)
+	ready, _ := servers.healthChecker.Ready()
+	require.False(t, ready)
+
+	// no new connection
+	_, err = net.Dial("tcp", listener.Addr().String())
+	require.Error(t, err)
+}
+
+func TestDrainStopsCallsAfterGrace(t *testing.T) {
+	t.Parallel()
+
+	servers := newTestServers(t, service.RateLimits{})
+	calls := &activeCalls{}
+	server, address := servers.serve(t, defaultConfig().Server, calls)
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", servers.adminToken)
+	// with no laptop, the watch only sends its resume token and never ends
+	// on its own
+	stream, err := pb.NewLaptopServiceClient(conn).WatchLaptops(ctx, &pb.WatchLaptopsRequest{})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.GetLaptop())
+	require.Eventually(t, func() bool {
+		return calls.count.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	grace := 200 * time.Millisecond
+	start := time.Now()
+	drain(server, servers.grpcServer, servers.gatewayServer, servers.healthChecker, calls, grace)
+	require.GreaterOrEqual(t, time.Since(start), grace)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	_, err = stream.Recv()
+	require.Error(t, err)
+	require.NotEqual(t, codes.OK, status.Code(err))
+}
+
+func TestMetricsServedApart(t *testing.T) {
+	t.Parallel()
+
+	servers := newTestServers(t, service.RateLimits{})
+
+	rec := httptest.NewRecorder()
+	servers.rest.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	newMetricsServer(servers.registry, defaultConfig().Server).Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "pcbook_laptops 0")
+}
+
+func TestPeerRateLimitBeforeAuth(t *testing.T) {
+	t.Parallel()
+
+	servers := newTestServers(t, service.RateLimits{Peer: service.RateLimit{Rate: 0.01, Burst: 1}})
+
+	createLaptop := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/laptop/create", bytes.NewReader([]byte("{}")))
+		req.Header.Set("Authorization", "forged-token")
+		rec := httptest.NewRecorder()
+		servers.rest.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, createLaptop())
+	// rejected before its token is checked
+	require.Equal(t, http.StatusTooManyRequests, createLaptop())
+}
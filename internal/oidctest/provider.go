@@ -0,0 +1,253 @@
+// Package oidctest runs an OpenID Connect provider in process, so the OIDC
+// login can be tested offline. Every authorization is approved at once for
+// the user given to SignIn.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/golang-jwt/jwt"
+)
+
+const keyID = "oidctest"
+
+type Provider struct {
+	ClientID     string
+	ClientSecret string
+
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mutex          sync.Mutex
+	claims         map[string]interface{}
+	authorizations map[string]*authorization
+}
+
+type authorization struct {
+	claims        map[string]interface{}
+	nonce         string
+	codeChallenge string
+	redirectURI   string
+}
+
+// NewProvider starts a provider accepting the given client. Close it when
+// done.
+func NewProvider(clientID, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("cant generate signing key: %w", err)
+	}
+
+	provider := &Provider{
+		ClientID:       clientID,
+		ClientSecret:   clientSecret,
+		key:            key,
+		authorizations: make(map[string]*authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("/authorize", provider.authorize)
+	mux.HandleFunc("/token", provider.token)
+	mux.HandleFunc("/keys", provider.keys)
+	provider.server = httptest.NewServer(mux)
+
+	return provider, nil
+}
+
+// Issuer is the URL to discover the provider from.
+func (p *Provider) Issuer() string {
+	return p.server.URL
+}
+
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+// SignIn sets the claims of the ID tokens issued from now on, "sub" at
+// least.
+func (p *Provider) SignIn(claims map[string]interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.claims = claims
+}
+
+// Authorize plays the browser: it opens the authorization URL and returns
+// the code and state the provider redirects back with.
+func (p *Provider) Authorize(authorizationURL string) (code string, state string, err error) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(authorizationURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		return "", "", fmt.Errorf("authorization failed with status %v", res.Status)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+	return location.Query().Get("code"), location.Query().Get("state"), nil
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer(),
+		"authorization_endpoint":                p.Issuer() + "/authorize",
+		"token_endpoint":                        p.Issuer() + "/token",
+		"jwks_uri":                              p.Issuer() + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != p.ClientID || query.Get("response_type") != "code" {
+		http.Error(w, "invalid client or response type", http.StatusBadRequest)
+		return
+	}
+
+	p.mutex.Lock()
+	if p.claims == nil {
+		p.mutex.Unlock()
+		http.Error(w, "nobody signed in", http.StatusUnauthorized)
+		return
+	}
+	code := randomString()
+	p.authorizations[code] = &authorization{
+		claims:        p.claims,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		redirectURI:   query.Get("redirect_uri"),
+	}
+	p.mutex.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.ClientID || clientSecret != p.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	p.mutex.Lock()
+	auth := p.authorizations[r.PostForm.Get("code")]
+	delete(p.authorizations, r.PostForm.Get("code"))
+	p.mutex.Unlock()
+
+	err = auth.check(r.PostForm)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": err.Error()})
+		return
+	}
+
+	idToken, err := p.idToken(auth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (a *authorization) check(form url.Values) error {
+	if a == nil || form.Get("grant_type") != "authorization_code" {
+		return errors.New("unknown code")
+	}
+	if form.Get("redirect_uri") != a.redirectURI {
+		return errors.New("redirect_uri mismatch")
+	}
+	if len(a.codeChallenge) > 0 {
+		sum := sha256.Sum256([]byte(form.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != a.codeChallenge {
+			return errors.New("code_verifier mismatch")
+		}
+	}
+	return nil
+}
+
+func (p *Provider) idToken(auth *authorization) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": p.Issuer(),
+		"aud": p.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	if len(auth.nonce) > 0 {
+		claims["nonce"] = auth.nonce
+	}
+	for name, value := range auth.claims {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(p.key)
+}
+
+func (p *Provider) keys(w http.ResponseWriter, r *http.Request) {
+	key := &service.VerificationKey{KeyID: keyID, Method: jwt.SigningMethodRS256, PublicKey: &p.key.PublicKey}
+	writeJSON(w, http.StatusOK, &service.JSONWebKeySet{Keys: []service.JSONWebKey{key.JSONWebKey()}})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func randomString() string {
+	data := make([]byte, 16)
+	_, _ = rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
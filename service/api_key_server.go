@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type APIKeyServer struct {
+	apiKeyStore APIKeyStore
+	pb.UnimplementedAPIKeyServiceServer
+}
+
+// NewAPIKeyServer returns a server managing the keys of apiKeyStore.
+// Like users, admins only see the keys of their own tenant.
+func NewAPIKeyServer(apiKeyStore APIKeyStore) *APIKeyServer {
+	return &APIKeyServer{apiKeyStore: apiKeyStore}
+}
+
+func (s *APIKeyServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	claims := UserClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "not yet sent token")
+	}
+	if claims.TokenType == APIKeyTokenType {
+		return nil, status.Errorf(codes.PermissionDenied, "an api key cant create api keys")
+	}
+
+	if len(req.GetScopes()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "api key needs at least one scope")
+	}
+	for _, scope := range req.GetScopes() {
+		err := ValidateScope(scope)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	if req.GetExpireTime() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "api key needs an expire time")
+	}
+	expiresAt := req.GetExpireTime().AsTime()
+	now := time.Now()
+	if !expiresAt.After(now) || expiresAt.After(now.Add(MaxAPIKeyLifetime)) {
+		return nil, status.Errorf(codes.InvalidArgument, "expire time must be in the next %v", MaxAPIKeyLifetime)
+	}
+
+	apiKey, key, err := NewAPIKey(req.GetLabel(), req.GetScopes(), claims.Username, claims.Tenant, expiresAt)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant create api key: %v", err)
+	}
+
+	err = s.apiKeyStore.Save(apiKey)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant save api key: %v", err)
+	}
+
+	return &pb.CreateAPIKeyResponse{ApiKey: toPBAPIKey(apiKey), Key: key}, nil
+}
+
+func (s *APIKeyServer) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	apiKeys, err := s.apiKeyStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant list api keys: %v", err)
+	}
+
+	res := &pb.ListAPIKeysResponse{}
+	for _, apiKey := range apiKeys {
+		if canSeeAPIKey(ctx, apiKey) {
+			res.ApiKeys = append(res.ApiKeys, toPBAPIKey(apiKey))
+		}
+	}
+
+	return res, nil
+}
+
+func (s *APIKeyServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+	apiKey, err := s.apiKeyStore.Find(req.GetId())
+	if err != nil || !canSeeAPIKey(ctx, apiKey) {
+		return nil, status.Errorf(codes.NotFound, "cant find api key %v", req.GetId())
+	}
+
+	apiKey.Revoked = true
+	err = s.apiKeyStore.Update(apiKey)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotExist) {
+			code = codes.NotFound
+		}
+		return nil, status.Errorf(code, "cant save api key: %v", err)
+	}
+
+	return &pb.RevokeAPIKeyResponse{ApiKey: toPBAPIKey(apiKey)}, nil
+}
+
+func canSeeAPIKey(ctx context.Context, apiKey *APIKey) bool {
+	return isSuperAdmin(ctx) || apiKey.Tenant == TenantFromContext(ctx)
+}
+
+func toPBAPIKey(apiKey *APIKey) *pb.APIKey {
+	return &pb.APIKey{
+		Id:         apiKey.ID,
+		Label:      apiKey.Label,
+		Scopes:     apiKey.Scopes,
+		CreatedBy:  apiKey.CreatedBy,
+		CreateTime: timestamppb.New(apiKey.CreatedAt),
+		ExpireTime: timestamppb.New(apiKey.ExpiresAt),
+		Revoked:    apiKey.Revoked,
+	}
+}
@@ -0,0 +1,97 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestServerAPIKey(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	server := service.NewAPIKeyServer(apiKeyStore)
+
+	admin, err := service.NewUser("alice", "alice-long-secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	interceptor := service.NewAuthInterceptor(jwtManager, userStore, service.NewInMemoryRevocationStore(), apiKeyStore,
+		newTestPolicy(t, map[string]string{
+			"/pb.LaptopService/CreateLaptop": "laptop.write",
+			"/pb.LaptopService/DeleteLaptop": "laptop.write",
+		}))
+	call := func(key string, method string) (*service.UserClaims, error) {
+		var claims *service.UserClaims
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", key))
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := interceptor.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			claims = service.UserClaimsFromContext(ctx)
+			return nil, nil
+		})
+		return claims, err
+	}
+
+	adminCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "alice", Role: "admin"})
+	expireTime := timestamppb.New(time.Now().Add(time.Hour))
+
+	invalid := []*pb.CreateAPIKeyRequest{
+		{Label: "no scope", ExpireTime: expireTime},
+		{Label: "all", Scopes: []string{"*"}, ExpireTime: expireTime},
+		{Label: "unknown", Scopes: []string{"/pb.LaptopService/Unknown"}, ExpireTime: expireTime},
+		{Label: "no expiry", Scopes: []string{"/pb.LaptopService/CreateLaptop"}},
+		{Label: "expired", Scopes: []string{"/pb.LaptopService/CreateLaptop"}, ExpireTime: timestamppb.New(time.Now().Add(-time.Hour))},
+	}
+	for _, req := range invalid {
+		_, err := server.CreateAPIKey(adminCtx, req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), req.GetLabel())
+	}
+
+	res, err := server.CreateAPIKey(adminCtx, &pb.CreateAPIKeyRequest{
+		Label:      "import job",
+		Scopes:     []string{"/pb.LaptopService/CreateLaptop"},
+		ExpireTime: expireTime,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetKey())
+	require.Equal(t, "alice", res.GetApiKey().GetCreatedBy())
+
+	stored, err := apiKeyStore.Find(res.GetApiKey().GetId())
+	require.NoError(t, err)
+	require.NotContains(t, res.GetKey(), stored.HashedKey)
+
+	claims, err := call(res.GetKey(), "/pb.LaptopService/CreateLaptop")
+	require.NoError(t, err)
+	require.Equal(t, "alice", claims.Username)
+	require.Equal(t, service.APIKeyTokenType, claims.TokenType)
+
+	_, err = call(res.GetKey(), "/pb.LaptopService/DeleteLaptop")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = call(res.GetKey()+"x", "/pb.LaptopService/CreateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	list, err := server.ListAPIKeys(adminCtx, &pb.ListAPIKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetApiKeys(), 1)
+
+	otherTenantCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "bob", Role: "admin", Tenant: "acme"})
+	_, err = server.RevokeAPIKey(otherTenantCtx, &pb.RevokeAPIKeyRequest{Id: res.GetApiKey().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	revoked, err := server.RevokeAPIKey(adminCtx, &pb.RevokeAPIKeyRequest{Id: res.GetApiKey().GetId()})
+	require.NoError(t, err)
+	require.True(t, revoked.GetApiKey().GetRevoked())
+	_, err = call(res.GetKey(), "/pb.LaptopService/CreateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
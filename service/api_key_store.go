@@ -0,0 +1,76 @@
+package service
+
+import (
+	"sort"
+	"sync"
+)
+
+type APIKeyStore interface {
+	Save(apiKey *APIKey) error
+	Update(apiKey *APIKey) error
+	Find(id string) (*APIKey, error)
+	// List returns the keys ordered by creation time.
+	List() ([]*APIKey, error)
+}
+
+type InMemoryAPIKeyStore struct {
+	apiKeys map[string]*APIKey
+	mutex   sync.RWMutex
+}
+
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{
+		apiKeys: make(map[string]*APIKey),
+	}
+}
+
+func (store *InMemoryAPIKeyStore) Save(apiKey *APIKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.apiKeys[apiKey.ID] != nil {
+		return ErrAlreadyExist
+	}
+
+	store.apiKeys[apiKey.ID] = apiKey.Clone()
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) Update(apiKey *APIKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.apiKeys[apiKey.ID] == nil {
+		return ErrNotExist
+	}
+
+	store.apiKeys[apiKey.ID] = apiKey.Clone()
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) Find(id string) (*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	apiKey := store.apiKeys[id]
+	if apiKey == nil {
+		return nil, ErrNotExist
+	}
+
+	return apiKey.Clone(), nil
+}
+
+func (store *InMemoryAPIKeyStore) List() ([]*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	apiKeys := make([]*APIKey, 0, len(store.apiKeys))
+	for _, apiKey := range store.apiKeys {
+		apiKeys = append(apiKeys, apiKey.Clone())
+	}
+	sort.Slice(apiKeys, func(a, b int) bool {
+		return apiKeys[a].CreatedAt.Before(apiKeys[b].CreatedAt)
+	})
+
+	return apiKeys, nil
+}
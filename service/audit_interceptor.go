@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultAuditedMethods are the calls changing data or authenticating. Like
+// the policy rules, "/package.Service/*" matches every method of a service.
+var DefaultAuditedMethods = []string{
+	"/pb.LaptopService/CreateLaptop",
+	"/pb.LaptopService/UpdateLaptop",
+	"/pb.LaptopService/DeleteLaptop",
+	"/pb.LaptopService/UploadImage",
+	"/pb.LaptopService/RateLaptop",
+	"/pb.AuthService/Login",
+	"/pb.AuthService/RefreshToken",
+	"/pb.AuthService/Logout",
+	"/pb.AuthService/Register",
+	"/pb.AuthService/ChangePassword",
+	"/pb.AuthService/FinishOIDCLogin",
+	"/pb.UserAdminService/*",
+	"/pb.APIKeyService/*",
+	"/pb.AuditService/*",
+}
+
+// AuditInterceptor writes a record of every audited call to the audit log.
+// It must run before the AuthInterceptor, which tells it who the caller is,
+// so that rejected calls are recorded too.
+type AuditInterceptor struct {
+	auditLog AuditLog
+	methods  map[string]bool
+}
+
+func NewAuditInterceptor(auditLog AuditLog, methods []string) *AuditInterceptor {
+	interceptor := &AuditInterceptor{
+		auditLog: auditLog,
+		methods:  make(map[string]bool),
+	}
+	for _, method := range methods {
+		interceptor.methods[method] = true
+	}
+	return interceptor
+}
+
+func (i *AuditInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		if !i.audits(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		record := newAuditRecord(ctx, info.FullMethod)
+		ctx = contextWithAuditRecord(ctx, record)
+
+		record.addMessage(req)
+		resp, err = handler(ctx, req)
+		if err == nil {
+			record.addMessage(resp)
+		}
+
+		i.append(record, err)
+		return resp, err
+	}
+}
+
+func (i *AuditInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(server interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if !i.audits(info.FullMethod) {
+			return handler(server, stream)
+		}
+
+		record := newAuditRecord(stream.Context(), info.FullMethod)
+		err := handler(server, &auditServerStream{
+			ServerStream: stream,
+			ctx:          contextWithAuditRecord(stream.Context(), record),
+			record:       record,
+		})
+
+		i.append(record, err)
+		return err
+	}
+}
+
+func (i *AuditInterceptor) audits(method string) bool {
+	if i.methods[method] {
+		return true
+	}
+	if j := strings.LastIndex(method, "/"); j > 0 {
+		return i.methods[method[:j+1]+"*"]
+	}
+	return false
+}
+
+func (i *AuditInterceptor) append(record *auditRecordBuilder, err error) {
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+
+	record.Code = status.Code(err).String()
+	// a failed audit write must not hide the outcome of the call
+	appendErr := i.auditLog.Append(&record.AuditRecord)
+	if appendErr != nil {
+		slog.Error("cant write audit record", "method", record.Method, "error", appendErr)
+	}
+}
+
+type auditRecordKey struct{}
+
+// auditRecordBuilder collects the record while the call runs. Streams can
+// be read and written from different goroutines.
+type auditRecordBuilder struct {
+	mutex sync.Mutex
+	AuditRecord
+}
+
+func newAuditRecord(ctx context.Context, method string) *auditRecordBuilder {
+	record := &auditRecordBuilder{}
+	record.Time = time.Now().UTC()
+	record.Method = method
+	if p, ok := peer.FromContext(ctx); ok {
+		record.Peer = p.Addr.String()
+	}
+	return record
+}
+
+func contextWithAuditRecord(ctx context.Context, record *auditRecordBuilder) context.Context {
+	return context.WithValue(ctx, auditRecordKey{}, record)
+}
+
+// setAuditCaller records the authenticated caller of an audited call.
+func setAuditCaller(ctx context.Context, claims *UserClaims) {
+	record, ok := ctx.Value(auditRecordKey{}).(*auditRecordBuilder)
+	if !ok || claims == nil {
+		return
+	}
+
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+
+	record.Username = claims.Username
+	record.Role = claims.Role
+	record.Tenant = claims.Tenant
+}
+
+// setAuditTenant records the tenant of the user a call without caller,
+// such as a login, acts on, so that the admins of the tenant see it.
+func setAuditTenant(ctx context.Context, tenant string) {
+	record, ok := ctx.Value(auditRecordKey{}).(*auditRecordBuilder)
+	if !ok {
+		return
+	}
+
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+
+	if len(record.Username) == 0 {
+		record.Tenant = tenant
+	}
+}
+
+// addMessage picks the laptop, image and user IDs out of a request or
+// response.
+func (r *auditRecordBuilder) addMessage(msg interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch msg := msg.(type) {
+	case *pb.CreateLaptopResponse:
+		r.addLaptopID(msg.GetId())
+	case *pb.UpdateLaptopRequest:
+		r.addLaptopID(msg.GetLaptop().GetId())
+	case *pb.DeleteLaptopRequest:
+		r.addLaptopID(msg.GetId())
+	case *pb.UploadImageRequest:
+		r.addLaptopID(msg.GetInfo().GetLaptopId())
+	case *pb.UploadImageResponse:
+		r.ImageID = msg.GetId()
+	case *pb.RateLaptopRequest:
+		r.addLaptopID(msg.GetLaptopId())
+	case interface{ GetUsername() string }:
+		if len(r.TargetUsername) == 0 {
+			r.TargetUsername = msg.GetUsername()
+		}
+	}
+}
+
+func (r *auditRecordBuilder) addLaptopID(id string) {
+	if len(id) == 0 {
+		return
+	}
+	for _, known := range r.LaptopIDs {
+		if known == id {
+			return
+		}
+	}
+	r.LaptopIDs = append(r.LaptopIDs, id)
+}
+
+type auditServerStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	record *auditRecordBuilder
+}
+
+func (s *auditServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *auditServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.record.addMessage(m)
+	}
+	return err
+}
+
+func (s *auditServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.record.addMessage(m)
+	}
+	return err
+}
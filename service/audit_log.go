@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrAuditChainBroken = errors.New("audit log hash chain is broken")
+
+// AuditRecord is one audited call. Hash is the HMAC-SHA256 of PrevHash and
+// of the record without Hash, so changing or removing a record breaks the
+// chain after it.
+type AuditRecord struct {
+	Seq            uint64    `json:"seq"`
+	Time           time.Time `json:"time"`
+	Username       string    `json:"username,omitempty"`
+	Role           string    `json:"role,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Method         string    `json:"method"`
+	LaptopIDs      []string  `json:"laptop_ids,omitempty"`
+	ImageID        string    `json:"image_id,omitempty"`
+	TargetUsername string    `json:"target_username,omitempty"`
+	Code           string    `json:"code"`
+	Peer           string    `json:"peer,omitempty"`
+	PrevHash       string    `json:"prev_hash"`
+	Hash           string    `json:"hash"`
+}
+
+// AuditLog is append only.
+type AuditLog interface {
+	Append(record *AuditRecord) error
+	// Query calls found with the records in order until it returns false.
+	Query(found func(record *AuditRecord) bool) error
+}
+
+// FileAuditLog writes the records as JSON lines.
+type FileAuditLog struct {
+	path  string
+	key   []byte
+	mutex sync.Mutex
+	file  *os.File
+	// size is the length of the records written, Query reads up to it
+	// while the next ones are appended.
+	size     int64
+	seq      uint64
+	lastHash string
+}
+
+// NewFileAuditLog opens the log, or creates it, after checking its chain.
+// key signs the chain, so that rewriting it needs more than access to the
+// file. A last record partly written before a crash is dropped.
+func NewFileAuditLog(path string, key []byte) (*FileAuditLog, error) {
+	if len(key) == 0 {
+		return nil, errors.New("audit log needs a key")
+	}
+	auditLog := &FileAuditLog{path: path, key: key}
+
+	size, err := auditLog.scan(-1, func(record *AuditRecord) bool {
+		auditLog.seq = record.Seq
+		auditLog.lastHash = record.Hash
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	auditLog.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cant open audit log: %w", err)
+	}
+
+	info, err := auditLog.file.Stat()
+	if err != nil {
+		auditLog.file.Close()
+		return nil, fmt.Errorf("cant stat audit log: %w", err)
+	}
+	if info.Size() > size {
+		slog.Warn("dropping partly written audit record", "path", path, "bytes", info.Size()-size)
+		err = auditLog.file.Truncate(size)
+		if err != nil {
+			auditLog.file.Close()
+			return nil, fmt.Errorf("cant truncate audit log: %w", err)
+		}
+	}
+	auditLog.size = size
+
+	// kept by the log collector, the head tells if records were removed
+	// from the end
+	slog.Info("audit log opened", "path", path, "seq", auditLog.seq, "hash", auditLog.lastHash)
+	return auditLog, nil
+}
+
+// Append numbers and chains the record, then writes it.
+func (l *FileAuditLog) Append(record *AuditRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record.Seq = l.seq + 1
+	record.PrevHash = l.lastHash
+	hash, err := l.hash(record)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cant encode audit record: %w", err)
+	}
+
+	n, err := l.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("cant write audit record: %w", err)
+	}
+
+	l.size += int64(n)
+	l.seq = record.Seq
+	l.lastHash = record.Hash
+	return nil
+}
+
+// Query checks the chain while reading, and fails with ErrAuditChainBroken
+// at the first record not matching it. It reads the records written when
+// it starts, without blocking Append.
+func (l *FileAuditLog) Query(found func(record *AuditRecord) bool) error {
+	l.mutex.Lock()
+	size := l.size
+	l.mutex.Unlock()
+
+	_, err := l.scan(size, found)
+	return err
+}
+
+// scan reads the records in the first limit bytes of the file, the whole
+// file if limit is negative, and returns the length of the complete lines
+// read. A last line with no line break is left out.
+func (l *FileAuditLog) scan(limit int64, found func(record *AuditRecord) bool) (int64, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if limit >= 0 {
+		reader = io.LimitReader(file, limit)
+	}
+	lines := bufio.NewReader(reader)
+
+	var size int64
+	var seq uint64
+	prevHash := ""
+	for {
+		line, err := lines.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		size += int64(len(line))
+
+		record := &AuditRecord{}
+		err = json.Unmarshal(line, record)
+		if err != nil {
+			return size, fmt.Errorf("%w: record %d is not valid JSON", ErrAuditChainBroken, seq+1)
+		}
+
+		hash, err := l.hash(record)
+		if err != nil {
+			return size, err
+		}
+		if record.Seq != seq+1 || record.PrevHash != prevHash || !hmac.Equal([]byte(record.Hash), []byte(hash)) {
+			return size, fmt.Errorf("%w: at record %d", ErrAuditChainBroken, seq+1)
+		}
+		seq, prevHash = record.Seq, record.Hash
+
+		if !found(record) {
+			return size, nil
+		}
+	}
+}
+
+// Close syncs the records to disk.
+func (l *FileAuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.file.Sync()
+	if err != nil {
+		l.file.Close()
+		return fmt.Errorf("cant sync audit log: %w", err)
+	}
+	slog.Info("audit log closed", "path", l.path, "seq", l.seq, "hash", l.lastHash)
+	return l.file.Close()
+}
+
+// hash is the HMAC-SHA256 of PrevHash and of the record without Hash.
+func (l *FileAuditLog) hash(record *AuditRecord) (string, error) {
+	unhashed := *record
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", fmt.Errorf("cant encode audit record: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(record.PrevHash))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Check tells if the log file is still where it is appended to, records
+// written to a removed file would be lost.
+func (l *FileAuditLog) Check(ctx context.Context) error {
+	_, err := os.Stat(l.path)
+	if err != nil {
+		return fmt.Errorf("audit log is gone: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+type AuditServer struct {
+	auditLog AuditLog
+	pb.UnimplementedAuditServiceServer
+}
+
+// NewAuditServer returns a server querying auditLog. Admins only see the
+// records of their own tenant, super admins see them all.
+func NewAuditServer(auditLog AuditLog) *AuditServer {
+	return &AuditServer{auditLog: auditLog}
+}
+
+func (s *AuditServer) QueryAuditLog(ctx context.Context, req *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultAuditPageSize
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+
+	var after uint64
+	if len(req.GetPageToken()) > 0 {
+		var err error
+		after, err = strconv.ParseUint(req.GetPageToken(), 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token %q", req.GetPageToken())
+		}
+	}
+
+	res := &pb.QueryAuditLogResponse{}
+	err := s.auditLog.Query(func(record *AuditRecord) bool {
+		if record.Seq <= after || !canSeeAuditRecord(ctx, record) || !auditRecordMatches(record, req) {
+			return true
+		}
+		if len(res.Records) == pageSize {
+			res.NextPageToken = strconv.FormatUint(res.Records[pageSize-1].Seq, 10)
+			return false
+		}
+		res.Records = append(res.Records, toPBAuditRecord(record))
+		return true
+	})
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAuditChainBroken) {
+			code = codes.DataLoss
+		}
+		return nil, status.Errorf(code, "cant query audit log: %v", err)
+	}
+
+	return res, nil
+}
+
+// canSeeAuditRecord hides the records of the other tenants from the admins.
+// A record with neither caller nor tenant, such as the login of an unknown
+// user or of a user of the default tenant, could concern any tenant: only
+// the super admins see it.
+func canSeeAuditRecord(ctx context.Context, record *AuditRecord) bool {
+	if isSuperAdmin(ctx) {
+		return true
+	}
+	if len(record.Username) == 0 && record.Tenant == DefaultTenant {
+		return false
+	}
+	return record.Tenant == TenantFromContext(ctx)
+}
+
+func auditRecordMatches(record *AuditRecord, req *pb.QueryAuditLogRequest) bool {
+	if len(req.GetUsername()) > 0 && record.Username != req.GetUsername() && record.TargetUsername != req.GetUsername() {
+		return false
+	}
+	if len(req.GetMethod()) > 0 && record.Method != req.GetMethod() {
+		return false
+	}
+	if req.GetStartTime() != nil && record.Time.Before(req.GetStartTime().AsTime()) {
+		return false
+	}
+	if req.GetEndTime() != nil && !record.Time.Before(req.GetEndTime().AsTime()) {
+		return false
+	}
+
+	if len(req.GetLaptopId()) == 0 {
+		return true
+	}
+	for _, id := range record.LaptopIDs {
+		if id == req.GetLaptopId() {
+			return true
+		}
+	}
+	return false
+}
+
+func toPBAuditRecord(record *AuditRecord) *pb.AuditRecord {
+	return &pb.AuditRecord{
+		Seq:            record.Seq,
+		Time:           timestamppb.New(record.Time),
+		Username:       record.Username,
+		Role:           record.Role,
+		Tenant:         record.Tenant,
+		Method:         record.Method,
+		LaptopIds:      record.LaptopIDs,
+		ImageId:        record.ImageID,
+		TargetUsername: record.TargetUsername,
+		Code:           record.Code,
+		Peer:           record.Peer,
+		PrevHash:       record.PrevHash,
+		Hash:           record.Hash,
+	}
+}
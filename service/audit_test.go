@@ -0,0 +1,244 @@
+package service_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var auditKey = []byte("audit-test-key")
+
+func TestAuditInterceptor(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := service.NewFileAuditLog(path, auditKey)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	userStore := service.NewInMemoryUserStore()
+	admin, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+
+	policy, err := service.NewPolicyManager(&service.Policy{
+		Rules: []service.PolicyRule{
+			{Method: "/pb.LaptopService/*", Roles: []string{"admin"}},
+			{Method: "/pb.AuthService/Login", Public: true},
+		},
+	})
+	require.NoError(t, err)
+
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	token, err := jwtManager.Generate(admin)
+	require.NoError(t, err)
+
+	auditInterceptor := service.NewAuditInterceptor(auditLog, service.DefaultAuditedMethods)
+	authInterceptor := service.NewAuthInterceptor(jwtManager, userStore,
+		service.NewInMemoryRevocationStore(), service.NewInMemoryAPIKeyStore(), policy)
+
+	call := func(ctx context.Context, method string, req interface{}, res interface{}) error {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := auditInterceptor.Unary()(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return authInterceptor.Unary()(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return res, nil
+			})
+		})
+		return err
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4242}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+	authCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", token))
+
+	err = call(ctx, "/pb.AuthService/Login", &pb.LoginRequest{Username: "admin1"}, &pb.LoginResponse{})
+	require.NoError(t, err)
+	err = call(authCtx, "/pb.LaptopService/CreateLaptop", &pb.CreateLaptopRequest{}, &pb.CreateLaptopResponse{Id: "laptop-1"})
+	require.NoError(t, err)
+	err = call(ctx, "/pb.LaptopService/DeleteLaptop", &pb.DeleteLaptopRequest{Id: "laptop-1"}, &pb.DeleteLaptopResponse{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	// searches are not audited
+	err = call(authCtx, "/pb.LaptopService/SearchLaptop", &pb.SearchLaptopRequest{}, nil)
+	require.NoError(t, err)
+
+	var records []*service.AuditRecord
+	err = auditLog.Query(func(record *service.AuditRecord) bool {
+		records = append(records, record)
+		return true
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	require.Equal(t, "/pb.AuthService/Login", records[0].Method)
+	require.Empty(t, records[0].Username)
+	require.Equal(t, "admin1", records[0].TargetUsername)
+	require.Equal(t, "10.0.0.1:4242", records[0].Peer)
+	require.Empty(t, records[0].PrevHash)
+
+	require.Equal(t, "admin1", records[1].Username)
+	require.Equal(t, "admin", records[1].Role)
+	require.Equal(t, []string{"laptop-1"}, records[1].LaptopIDs)
+	require.Equal(t, codes.OK.String(), records[1].Code)
+	require.Equal(t, records[0].Hash, records[1].PrevHash)
+
+	require.Equal(t, []string{"laptop-1"}, records[2].LaptopIDs)
+	require.Equal(t, codes.Unauthenticated.String(), records[2].Code)
+	require.Equal(t, uint64(3), records[2].Seq)
+
+	// reopening carries on the chain
+	require.NoError(t, auditLog.Close())
+	auditLog, err = service.NewFileAuditLog(path, auditKey)
+	require.NoError(t, err)
+	err = auditLog.Append(&service.AuditRecord{Method: "/pb.UserAdminService/DeleteUser", Code: codes.OK.String()})
+	require.NoError(t, err)
+
+	server := service.NewAuditServer(auditLog)
+	superAdminCtx := service.ContextWithUserClaims(context.Background(),
+		&service.UserClaims{Username: "root", Role: service.SuperAdminRole})
+
+	res, err := server.QueryAuditLog(superAdminCtx, &pb.QueryAuditLogRequest{PageSize: 2})
+	require.NoError(t, err)
+	require.Len(t, res.GetRecords(), 2)
+	require.Equal(t, "2", res.GetNextPageToken())
+
+	res, err = server.QueryAuditLog(superAdminCtx, &pb.QueryAuditLogRequest{PageToken: res.GetNextPageToken()})
+	require.NoError(t, err)
+	require.Len(t, res.GetRecords(), 2)
+	require.Equal(t, uint64(4), res.GetRecords()[1].GetSeq())
+	require.Equal(t, res.GetRecords()[0].GetHash(), res.GetRecords()[1].GetPrevHash())
+	require.Empty(t, res.GetNextPageToken())
+
+	res, err = server.QueryAuditLog(superAdminCtx, &pb.QueryAuditLogRequest{LaptopId: "laptop-1", Username: "admin1"})
+	require.NoError(t, err)
+	require.Len(t, res.GetRecords(), 1)
+	require.Equal(t, "/pb.LaptopService/CreateLaptop", res.GetRecords()[0].GetMethod())
+
+	// admins of another tenant see nothing
+	otherCtx := service.ContextWithUserClaims(context.Background(),
+		&service.UserClaims{Username: "admin2", Role: "admin", Tenant: "acme"})
+	res, err = server.QueryAuditLog(otherCtx, &pb.QueryAuditLogRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.GetRecords())
+
+	// editing a record breaks the chain
+	require.NoError(t, auditLog.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	tampered := strings.Replace(string(data), `"code":"Unauthenticated"`, `"code":"OK"`, 1)
+	require.NotEqual(t, string(data), tampered)
+	require.NoError(t, os.WriteFile(path, []byte(tampered), 0600))
+
+	_, err = server.QueryAuditLog(superAdminCtx, &pb.QueryAuditLogRequest{})
+	require.Equal(t, codes.DataLoss, status.Code(err))
+	_, err = service.NewFileAuditLog(path, auditKey)
+	require.ErrorIs(t, err, service.ErrAuditChainBroken)
+}
+
+func TestAuditLoginVisibility(t *testing.T) {
+	t.Parallel()
+
+	auditLog, err := service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), auditKey)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	userStore := service.NewInMemoryUserStore()
+	for username, tenant := range map[string]string{"alice": "acme", "bob": service.DefaultTenant} {
+		user, err := service.NewUser(username, username+"-long-secret", "user")
+		require.NoError(t, err)
+		user.Tenant = tenant
+		require.NoError(t, userStore.Save(user))
+	}
+
+	authServer := service.NewAuthServer(userStore, service.NewJWTManager("secret", time.Minute, time.Hour),
+		service.NewInMemoryRevocationStore(), service.NewLoginLimiter(service.DefaultLoginLimits), nil)
+	auditInterceptor := service.NewAuditInterceptor(auditLog, service.DefaultAuditedMethods)
+	login := func(username string) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.AuthService/Login"}
+		_, err := auditInterceptor.Unary()(context.Background(), &pb.LoginRequest{Username: username, Password: "wrong-secret"}, info,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return authServer.Login(ctx, req.(*pb.LoginRequest))
+			})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+	login("alice")
+	login("bob")
+	login("nobody")
+
+	server := service.NewAuditServer(auditLog)
+	visible := func(claims *service.UserClaims) []string {
+		res, err := server.QueryAuditLog(service.ContextWithUserClaims(context.Background(), claims), &pb.QueryAuditLogRequest{})
+		require.NoError(t, err)
+		var usernames []string
+		for _, record := range res.GetRecords() {
+			usernames = append(usernames, record.GetTargetUsername())
+		}
+		return usernames
+	}
+
+	// the login of a tenant user is seen by the admins of its tenant only
+	require.Equal(t, []string{"alice"}, visible(&service.UserClaims{Username: "admin1", Role: "admin", Tenant: "acme"}))
+	require.Empty(t, visible(&service.UserClaims{Username: "admin2", Role: "admin", Tenant: "globex"}))
+	// a login of the default tenant or of an unknown user could concern
+	// any tenant
+	require.Empty(t, visible(&service.UserClaims{Username: "admin3", Role: "admin"}))
+	require.Equal(t, []string{"alice", "bob", "nobody"}, visible(&service.UserClaims{Username: "root", Role: service.SuperAdminRole}))
+}
+
+func TestFileAuditLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := service.NewFileAuditLog(path, auditKey)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, auditLog.Append(&service.AuditRecord{Method: "/pb.AuthService/Login", Code: codes.OK.String()}))
+	}
+
+	// a query reads the records written when it started, and does not
+	// hold up the calls appending meanwhile
+	var seqs []uint64
+	err = auditLog.Query(func(record *service.AuditRecord) bool {
+		seqs = append(seqs, record.Seq)
+		require.NoError(t, auditLog.Append(&service.AuditRecord{Method: "/pb.AuthService/Logout", Code: codes.OK.String()}))
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, seqs)
+	require.NoError(t, auditLog.Close())
+
+	// a record cut by a crash is dropped, the chain carries on
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"seq":7,"time":"2023-`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	auditLog, err = service.NewFileAuditLog(path, auditKey)
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Append(&service.AuditRecord{Method: "/pb.AuthService/Login", Code: codes.OK.String()}))
+	count := 0
+	err = auditLog.Query(func(record *service.AuditRecord) bool {
+		count++
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, 7, count)
+	require.NoError(t, auditLog.Close())
+
+	// a chain rebuilt without the key does not verify
+	_, err = service.NewFileAuditLog(path, []byte("another-key"))
+	require.ErrorIs(t, err, service.ErrAuditChainBroken)
+}
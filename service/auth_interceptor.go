@@ -2,25 +2,50 @@ package service
 
 import (
 	"context"
-	"log"
-	"strings"
+	"crypto/x509"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 type AuthInterceptor struct {
 	jwtManager      *JWTManager
-	accessibleRoles map[string][]string
+	userStore       UserStore
+	revocationStore RevocationStore
+	apiKeyStore     APIKeyStore
+	policy          *PolicyManager
+}
+
+type userClaimsKey struct{}
+
+// ContextWithUserClaims returns a copy of ctx carrying the caller's claims.
+func ContextWithUserClaims(ctx context.Context, claims *UserClaims) context.Context {
+	return context.WithValue(ctx, userClaimsKey{}, claims)
+}
+
+// UserClaimsFromContext returns the claims of the authenticated caller,
+// or nil for a public method called without a token.
+func UserClaimsFromContext(ctx context.Context) *UserClaims {
+	claims, _ := ctx.Value(userClaimsKey{}).(*UserClaims)
+	return claims
 }
 
 func NewAuthInterceptor(jwtManager *JWTManager,
-	accessibleRoles map[string][]string) *AuthInterceptor {
+	userStore UserStore,
+	revocationStore RevocationStore,
+	apiKeyStore APIKeyStore,
+	policy *PolicyManager) *AuthInterceptor {
 	return &AuthInterceptor{
 		jwtManager:      jwtManager,
-		accessibleRoles: accessibleRoles,
+		userStore:       userStore,
+		revocationStore: revocationStore,
+		apiKeyStore:     apiKeyStore,
+		policy:          policy,
 	}
 }
 
@@ -30,13 +55,14 @@ func (i *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (resp interface{}, err error) {
-
-		log.Println("Unary interceptor", info.FullMethod)
-
-		err = i.authorize(ctx, info.FullMethod)
+		claims, err := i.authorize(ctx, info.FullMethod)
 		if err != nil {
 			return nil, err
 		}
+		if claims != nil {
+			setAuditCaller(ctx, claims)
+			ctx = ContextWithUserClaims(ctx, claims)
+		}
 
 		return handler(ctx, req)
 	}
@@ -47,46 +73,166 @@ func (i *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 		stream grpc.ServerStream,
 		info *grpc.StreamServerInfo,
 		handler grpc.StreamHandler) error {
-
-		log.Println("Stream interceptor", info.FullMethod)
-
-		err := i.authorize(stream.Context(), info.FullMethod)
+		claims, err := i.authorize(stream.Context(), info.FullMethod)
 		if err != nil {
 			return err
 		}
+		if claims != nil {
+			setAuditCaller(stream.Context(), claims)
+			stream = &serverStreamWithContext{
+				ServerStream: stream,
+				ctx:          ContextWithUserClaims(stream.Context(), claims),
+			}
+		}
 
 		return handler(server, stream)
 	}
 }
 
-func (i *AuthInterceptor) authorize(ctx context.Context, method string) error {
+// serverStreamWithContext lets a stream interceptor hand a derived context
+// to the handler.
+type serverStreamWithContext struct {
+	grpc.ServerStream
+	ctx context.Context
+}
 
-	accessible, ok := i.accessibleRoles[method]
-	if ok {
-		md, exist := metadata.FromIncomingContext(ctx)
-		if !exist {
-			return status.Errorf(codes.Unauthenticated, "not yet sent token")
-		}
+func (s *serverStreamWithContext) Context() context.Context {
+	return s.ctx
+}
 
-		tokens := md["authorization"]
-		if tokens == nil {
-			return status.Errorf(codes.Unauthenticated, "token empty")
-		}
+func (i *AuthInterceptor) authorize(ctx context.Context, method string) (*UserClaims, error) {
+	policy := i.policy.Policy()
 
-		token := tokens[0]
-		claims, err := i.jwtManager.Verify(token)
-		if err != nil {
-			return status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	rule, ok := policy.Rule(method)
+	if !ok {
+		if policy.DefaultDeny {
+			return nil, status.Errorf(codes.PermissionDenied, "no policy for method %v", method)
 		}
+		return nil, nil
+	}
 
-		for _, role := range accessible {
-			if strings.EqualFold(role, claims.Role) {
-				return nil
-			}
-		}
+	if rule.Public {
+		return nil, nil
+	}
+
+	claims, err := i.authenticate(ctx, policy, method)
+	if err != nil {
+		return nil, err
+	}
+
+	if !policy.Permits(rule, claims.Role) {
+		return nil, status.Errorf(codes.PermissionDenied, "user dont have permission")
+	}
+
+	return claims, nil
+}
+
+// authenticate accepts a JWT, an API key scoped to the method, or without
+// them a verified client certificate mapped to a role by the policy.
+func (i *AuthInterceptor) authenticate(ctx context.Context, policy *Policy, method string) (*UserClaims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md["authorization"]
+	if len(tokens) > 0 {
+		return i.verifyToken(tokens[0])
+	}
+
+	apiKeys := md["x-api-key"]
+	if len(apiKeys) > 0 {
+		return i.verifyAPIKey(apiKeys[0], method)
+	}
+
+	cert := peerCertificate(ctx)
+	if cert == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "not yet sent token")
+	}
+
+	peerCert, ok := policy.PeerCertificate(cert)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "token empty and client certificate %q not mapped to a role", cert.Subject.CommonName)
+	}
+
+	return &UserClaims{
+		Username: peerCert.Username(),
+		Role:     peerCert.Role,
+		Tenant:   peerCert.Tenant,
+	}, nil
+}
+
+func (i *AuthInterceptor) verifyToken(token string) (*UserClaims, error) {
+	claims, err := i.jwtManager.Verify(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+
+	revoked, err := i.revocationStore.IsRevoked(claims.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant check token: %v", err)
+	}
+	if revoked {
+		return nil, status.Errorf(codes.Unauthenticated, "token is revoked")
+	}
+
+	// tokens outlive account changes, so check the account is still
+	// active and use its current role, organization and tenant
+	user, err := i.userStore.Find(claims.Username)
+	if err != nil || user.ID != claims.UserID || user.Disabled {
+		return nil, status.Errorf(codes.Unauthenticated, "user is deleted or disabled")
+	}
+	claims.Role = user.Role
+	claims.Organization = user.Organization
+	claims.Tenant = user.Tenant
+
+	return claims, nil
+}
+
+// verifyAPIKey returns the claims of the user who created the key.
+func (i *AuthInterceptor) verifyAPIKey(key string, method string) (*UserClaims, error) {
+	id, secret, err := ParseAPIKey(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+
+	apiKey, err := i.apiKeyStore.Find(id)
+	if err != nil || !apiKey.Matches(secret) {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", ErrInvalidAPIKey)
+	}
+	if !apiKey.IsActive(time.Now()) {
+		return nil, status.Errorf(codes.Unauthenticated, "api key is revoked or expired")
+	}
+	if !apiKey.Allows(method) {
+		return nil, status.Errorf(codes.PermissionDenied, "api key has no scope for method %v", method)
+	}
+
+	user, err := i.userStore.Find(apiKey.CreatedBy)
+	if err != nil || user.Disabled || user.Tenant != apiKey.Tenant {
+		return nil, status.Errorf(codes.Unauthenticated, "api key creator is deleted, disabled or moved")
+	}
+
+	claims := &UserClaims{
+		Username:     user.UserName,
+		Role:         user.Role,
+		TokenType:    APIKeyTokenType,
+		Organization: user.Organization,
+		Tenant:       user.Tenant,
+	}
+	claims.Id = apiKey.ID
+	claims.ExpiresAt = apiKey.ExpiresAt.Unix()
+
+	return claims, nil
+}
+
+// peerCertificate returns the client certificate verified by the TLS
+// handshake, if any.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
 
-		return status.Errorf(codes.PermissionDenied, "user dont have permission")
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
 	}
 
-	return nil
+	return tlsInfo.State.VerifiedChains[0][0]
 }
@@ -0,0 +1,84 @@
+package service_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthInterceptorPeerCertificate(t *testing.T) {
+	t.Parallel()
+
+	policy, err := service.NewPolicyManager(&service.Policy{
+		DefaultDeny: true,
+		Permissions: []string{"laptop.write"},
+		Roles:       map[string][]string{"admin": {"*"}},
+		Rules: []service.PolicyRule{
+			{Method: "/pb.LaptopService/CreateLaptop", Permission: "laptop.write"},
+		},
+		PeerCertificates: []service.PeerCertificate{
+			{CommonName: "inventory-sync", Role: "admin", Tenant: "acme"},
+			{URI: "spiffe://pcbook/reporting", Role: "user"},
+		},
+	})
+	require.NoError(t, err)
+
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	interceptor := service.NewAuthInterceptor(jwtManager, service.NewInMemoryUserStore(),
+		service.NewInMemoryRevocationStore(), service.NewInMemoryAPIKeyStore(), policy)
+
+	withCert := func(commonName string, uri string) context.Context {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		if len(uri) > 0 {
+			parsed, err := url.Parse(uri)
+			require.NoError(t, err)
+			cert.URIs = []*url.URL{parsed}
+		}
+		state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+	}
+
+	call := func(ctx context.Context) (*service.UserClaims, error) {
+		var claims *service.UserClaims
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.LaptopService/CreateLaptop"}
+		_, err := interceptor.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			claims = service.UserClaimsFromContext(ctx)
+			return nil, nil
+		})
+		return claims, err
+	}
+
+	claims, err := call(withCert("inventory-sync", ""))
+	require.NoError(t, err)
+	require.Equal(t, "cert:inventory-sync", claims.Username)
+	require.Equal(t, "admin", claims.Role)
+	require.Equal(t, "acme", claims.Tenant)
+
+	// the SAN URI wins over the common name
+	_, err = call(withCert("inventory-sync", "spiffe://pcbook/reporting"))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = call(withCert("unknown", ""))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = call(context.Background())
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a token, even invalid, is never replaced by the certificate
+	ctx := metadata.NewIncomingContext(withCert("inventory-sync", ""), metadata.Pairs("authorization", "invalid"))
+	_, err = call(ctx)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
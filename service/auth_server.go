@@ -2,41 +2,343 @@ package service
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// RegisteredUserRole is the role of the accounts created through Register.
+	RegisteredUserRole = "user"
+	// SuperAdminRole may modify every laptop, whoever owns it.
+	SuperAdminRole = "superadmin"
+)
+
 type AuthServer struct {
-	userStore  UserStore
-	jwtManager *JWTManager
+	userStore       UserStore
+	jwtManager      *JWTManager
+	revocationStore RevocationStore
+	loginLimiter    *LoginLimiter
+	// oidcProvider is nil when OIDC login is not configured
+	oidcProvider *OIDCProvider
 
 	pb.UnimplementedAuthServiceServer
 }
 
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
-	return &AuthServer{userStore: userStore, jwtManager: jwtManager}
+func NewAuthServer(userStore UserStore,
+	jwtManager *JWTManager,
+	revocationStore RevocationStore,
+	loginLimiter *LoginLimiter,
+	oidcProvider *OIDCProvider) *AuthServer {
+	return &AuthServer{
+		userStore:       userStore,
+		jwtManager:      jwtManager,
+		revocationStore: revocationStore,
+		loginLimiter:    loginLimiter,
+		oidcProvider:    oidcProvider,
+	}
 }
 
+// dummyUser is checked when the user does not exist, so a login takes as
+// long for an unknown user as for a wrong password.
+var dummyUser = func() *User {
+	user, _ := NewUser("dummy", "dummy-password", "")
+	return user
+}()
+
 func (s *AuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
-	user, err := s.userStore.Find(req.GetUsername())
+	username, ip := req.GetUsername(), peerIP(ctx)
+
+	// the attempt counts as a failure until the password is checked
+	wait := s.loginLimiter.Attempt(username, ip)
+	if wait > 0 {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many failed logins, retry in %v", wait.Round(time.Second))
+	}
+
+	user, err := s.userStore.Find(username)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "cant file user:%v", err)
+		user = nil
+		dummyUser.IsCorrectPw(req.GetPassword())
+	} else {
+		setAuditTenant(ctx, user.Tenant)
 	}
 
-	if user == nil || !user.IsCorrectPw(req.Password) {
+	// the same error for an unknown user and a wrong password, so the
+	// usernames cant be enumerated
+	if user == nil || !user.IsCorrectPw(req.GetPassword()) {
 		return nil, status.Errorf(codes.Unauthenticated, "incorrect user/pw")
 	}
+	s.loginLimiter.Succeed(username, ip)
 
-	token, err := s.jwtManager.Generate(user)
+	if user.Disabled {
+		return nil, status.Errorf(codes.PermissionDenied, "user is disabled")
+	}
+
+	accessToken, refreshToken, err := s.generateTokens(user)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "can generate token: %v", err)
+		return nil, err
 	}
 
 	res := &pb.LoginResponse{
-		AccessToken: token,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
 	}
 
 	return res, nil
 }
+
+func (s *AuthServer) StartOIDCLogin(ctx context.Context, req *pb.StartOIDCLoginRequest) (*pb.StartOIDCLoginResponse, error) {
+	if s.oidcProvider == nil {
+		return nil, status.Errorf(codes.Unimplemented, "OIDC login is not configured")
+	}
+
+	authURL, state, err := s.oidcProvider.AuthCodeURL()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant start OIDC login: %v", err)
+	}
+
+	return &pb.StartOIDCLoginResponse{
+		AuthorizationUrl: authURL,
+		State:            state,
+	}, nil
+}
+
+// FinishOIDCLogin creates the account of a new OIDC user, without password,
+// and updates its role from the identity provider on every login.
+func (s *AuthServer) FinishOIDCLogin(ctx context.Context, req *pb.FinishOIDCLoginRequest) (*pb.FinishOIDCLoginResponse, error) {
+	if s.oidcProvider == nil {
+		return nil, status.Errorf(codes.Unimplemented, "OIDC login is not configured")
+	}
+
+	identity, err := s.oidcProvider.Exchange(ctx, req.GetCode(), req.GetState())
+	if err != nil {
+		code := codes.Unauthenticated
+		if errors.Is(err, ErrOIDCNoRole) {
+			code = codes.PermissionDenied
+		}
+		return nil, status.Errorf(code, "OIDC login failed: %v", err)
+	}
+
+	err = ValidateUsername(identity.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.PermissionDenied, "cant use OIDC username %q: %v", identity.Username, err)
+	}
+
+	user, err := s.userStore.Update(identity.Username, func(user *User) error {
+		// never let the identity provider take over a local account
+		if user.ExternalID != identity.ExternalID {
+			return status.Errorf(codes.PermissionDenied, "username %v belongs to another account", identity.Username)
+		}
+		if user.Disabled {
+			return status.Errorf(codes.PermissionDenied, "user is disabled")
+		}
+		user.Role = identity.Role
+		return nil
+	})
+	if errors.Is(err, ErrNotExist) {
+		user = &User{UserName: identity.Username, Role: identity.Role, ExternalID: identity.ExternalID}
+		err = s.userStore.Save(user)
+	}
+	if status.Code(err) == codes.PermissionDenied {
+		return nil, err
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant save user: %v", err)
+	}
+
+	accessToken, refreshToken, err := s.generateTokens(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.FinishOIDCLoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// RefreshToken trades a refresh token for a new access/refresh pair.
+// The refresh token is revoked so it can only be used once.
+func (s *AuthServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	claims, err := s.verifyRefreshToken(req.GetRefreshToken())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userStore.Find(claims.Username)
+	if err != nil || user.ID != claims.UserID || user.Disabled {
+		return nil, status.Errorf(codes.Unauthenticated, "user is deleted or disabled")
+	}
+	setAuditTenant(ctx, user.Tenant)
+
+	// only the first of concurrent calls with the same token gets new ones
+	revoked, err := s.revocationStore.RevokeIfNotRevoked(claims.Id, claims.ExpiresTime())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant revoke refresh token: %v", err)
+	}
+	if !revoked {
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is revoked")
+	}
+
+	accessToken, refreshToken, err := s.generateTokens(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RefreshTokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// Logout revokes the refresh token and the access token of the caller.
+func (s *AuthServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	claims, err := s.verifyRefreshToken(req.GetRefreshToken())
+	if err != nil {
+		return nil, err
+	}
+
+	caller := UserClaimsFromContext(ctx)
+	if caller != nil && caller.Username != claims.Username {
+		return nil, status.Errorf(codes.PermissionDenied, "refresh token belongs to another user")
+	}
+
+	err = s.revocationStore.Revoke(claims.Id, claims.ExpiresTime())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant revoke refresh token: %v", err)
+	}
+
+	if caller != nil {
+		err = s.revocationStore.Revoke(caller.Id, caller.ExpiresTime())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cant revoke access token: %v", err)
+		}
+	}
+
+	return &pb.LogoutResponse{}, nil
+}
+
+func (s *AuthServer) verifyRefreshToken(token string) (*UserClaims, error) {
+	claims, err := s.jwtManager.VerifyRefresh(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid refresh token: %v", err)
+	}
+
+	revoked, err := s.revocationStore.IsRevoked(claims.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant check refresh token: %v", err)
+	}
+	if revoked {
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is revoked")
+	}
+
+	return claims, nil
+}
+
+func (s *AuthServer) generateTokens(user *User) (accessToken, refreshToken string, err error) {
+	accessToken, err = s.jwtManager.Generate(user)
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "can generate token: %v", err)
+	}
+
+	refreshToken, err = s.jwtManager.GenerateRefresh(user)
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "can generate refresh token: %v", err)
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+func (s *AuthServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	username, rawPw := req.GetUsername(), req.GetPassword()
+
+	err := ValidateUsername(username)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	err = ValidatePassword(username, rawPw)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	user, err := NewUser(username, rawPw, RegisteredUserRole)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant create user: %v", err)
+	}
+
+	err = s.userStore.Save(user)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExist) {
+			code = codes.AlreadyExists
+		}
+		return nil, status.Errorf(code, "cant save user: %v", err)
+	}
+
+	return &pb.RegisterResponse{
+		Username: user.UserName,
+		Role:     user.Role,
+	}, nil
+}
+
+func (s *AuthServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	claims := UserClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "not yet sent token")
+	}
+
+	user, err := s.userStore.Find(claims.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "cant find user: %v", err)
+	}
+
+	if !user.IsCorrectPw(req.GetOldPassword()) {
+		return nil, status.Errorf(codes.Unauthenticated, "incorrect user/pw")
+	}
+
+	err = ValidatePassword(user.UserName, req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	// the hashing is too slow to run in the store update, which fails if
+	// the password changed since it was checked
+	checkedHash := user.HashPw
+	err = user.SetPassword(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant hash password: %v", err)
+	}
+	newHash := user.HashPw
+
+	_, err = s.userStore.Update(user.UserName, func(user *User) error {
+		if user.HashPw != checkedHash {
+			return status.Errorf(codes.Aborted, "password changed meanwhile, try again")
+		}
+		user.HashPw = newHash
+		return nil
+	})
+	if status.Code(err) == codes.Aborted {
+		return nil, err
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant save user: %v", err)
+	}
+
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+func (s *AuthServer) GetMe(ctx context.Context, req *pb.GetMeRequest) (*pb.GetMeResponse, error) {
+	claims := UserClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "not yet sent token")
+	}
+
+	return &pb.GetMeResponse{
+		Username: claims.Username,
+		Role:     claims.Role,
+	}, nil
+}
@@ -0,0 +1,457 @@
+package service_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/internal/oidctest"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerRegister(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	server := service.NewAuthServer(userStore, service.NewJWTManager("secret", time.Minute, time.Hour), service.NewInMemoryRevocationStore(),
+		service.NewLoginLimiter(service.DefaultLoginLimits), nil)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		code     codes.Code
+	}{
+		{
+			name:     "success",
+			username: "alice",
+			password: "correct-horse-battery",
+			code:     codes.OK,
+		},
+		{
+			name:     "duplicateUsername",
+			username: "alice",
+			password: "another-long-secret",
+			code:     codes.AlreadyExists,
+		},
+		{
+			name:     "invalidUsername",
+			username: "a b",
+			password: "correct-horse-battery",
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "shortPassword",
+			username: "bob",
+			password: "short",
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "commonPassword",
+			username: "bob",
+			password: "Password1",
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "passwordContainsUsername",
+			username: "charlie",
+			password: "charlie-2023",
+			code:     codes.InvalidArgument,
+		},
+	}
+
+	// Not parallel: the duplicate case relies on the first one.
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &pb.RegisterRequest{Username: tc.username, Password: tc.password}
+			res, err := server.Register(context.Background(), req)
+			require.Equal(t, tc.code, status.Code(err))
+			if tc.code == codes.OK {
+				require.Equal(t, tc.username, res.GetUsername())
+				require.Equal(t, service.RegisteredUserRole, res.GetRole())
+			}
+		})
+	}
+
+	user, err := userStore.Find("alice")
+	require.NoError(t, err)
+	require.True(t, user.IsCorrectPw("correct-horse-battery"))
+}
+
+func TestServerChangePasswordAndGetMe(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	revocationStore := service.NewInMemoryRevocationStore()
+	server := service.NewAuthServer(userStore, jwtManager, revocationStore, service.NewLoginLimiter(service.DefaultLoginLimits), nil)
+
+	_, err := server.Register(context.Background(), &pb.RegisterRequest{
+		Username: "alice",
+		Password: "correct-horse-battery",
+	})
+	require.NoError(t, err)
+
+	_, err = server.GetMe(context.Background(), &pb.GetMeRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	user, err := userStore.Find("alice")
+	require.NoError(t, err)
+	token, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+	claims, err := jwtManager.Verify(token)
+	require.NoError(t, err)
+	ctx := service.ContextWithUserClaims(context.Background(), claims)
+
+	me, err := server.GetMe(ctx, &pb.GetMeRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "alice", me.GetUsername())
+	require.Equal(t, service.RegisteredUserRole, me.GetRole())
+
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{
+		OldPassword: "wrong-old-password",
+		NewPassword: "new-long-secret",
+	})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{
+		OldPassword: "correct-horse-battery",
+		NewPassword: "12345678",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{
+		OldPassword: "correct-horse-battery",
+		NewPassword: "new-long-secret",
+	})
+	require.NoError(t, err)
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "correct-horse-battery"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	res, err := server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "new-long-secret"})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetAccessToken())
+}
+
+func TestServerRefreshTokenAndLogout(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	revocationStore := service.NewInMemoryRevocationStore()
+	server := service.NewAuthServer(userStore, jwtManager, revocationStore, service.NewLoginLimiter(service.DefaultLoginLimits), nil)
+	interceptor := service.NewAuthInterceptor(jwtManager, userStore, revocationStore, service.NewInMemoryAPIKeyStore(),
+		newTestPolicy(t, map[string]string{"/pb.AuthService/Logout": "account.self"}))
+
+	user, err := service.NewUser("alice", "correct-horse-battery", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	login, err := server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "correct-horse-battery"})
+	require.NoError(t, err)
+	require.NotEmpty(t, login.GetRefreshToken())
+
+	// a refresh token is not an access token and the other way around
+	_, err = jwtManager.Verify(login.GetRefreshToken())
+	require.Error(t, err)
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetAccessToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	refreshed, err := server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+	require.NotEmpty(t, refreshed.GetAccessToken())
+	require.NotEqual(t, login.GetRefreshToken(), refreshed.GetRefreshToken())
+
+	// refresh tokens rotate, the old one is used up
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	logout := func() error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", refreshed.GetAccessToken()))
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.AuthService/Logout"}
+		_, err := interceptor.Unary()(ctx, &pb.LogoutRequest{RefreshToken: refreshed.GetRefreshToken()}, info,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return server.Logout(ctx, req.(*pb.LogoutRequest))
+			})
+		return err
+	}
+	require.NoError(t, logout())
+
+	// both the access and refresh token are revoked
+	require.Equal(t, codes.Unauthenticated, status.Code(logout()))
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServerTokensOfDeletedUser(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	revocationStore := service.NewInMemoryRevocationStore()
+	server := service.NewAuthServer(userStore, jwtManager, revocationStore, service.NewLoginLimiter(service.DefaultLoginLimits), nil)
+	interceptor := service.NewAuthInterceptor(jwtManager, userStore, revocationStore, service.NewInMemoryAPIKeyStore(),
+		newTestPolicy(t, map[string]string{"/pb.AuthService/GetMe": "account.self"}))
+
+	register := func() *pb.LoginResponse {
+		_, err := server.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "correct-horse-battery"})
+		require.NoError(t, err)
+		login, err := server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "correct-horse-battery"})
+		require.NoError(t, err)
+		return login
+	}
+	getMe := func(accessToken string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", accessToken))
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.AuthService/GetMe"}
+		_, err := interceptor.Unary()(ctx, &pb.GetMeRequest{}, info,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return server.GetMe(ctx, req.(*pb.GetMeRequest))
+			})
+		return err
+	}
+
+	old := register()
+	require.NoError(t, getMe(old.GetAccessToken()))
+
+	// the same name registered again is another user
+	require.NoError(t, userStore.Delete("alice"))
+	current := register()
+
+	require.Equal(t, codes.Unauthenticated, status.Code(getMe(old.GetAccessToken())))
+	_, err := server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: old.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	require.NoError(t, getMe(current.GetAccessToken()))
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: current.GetRefreshToken()})
+	require.NoError(t, err)
+}
+
+func TestServerConcurrentRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	server := service.NewAuthServer(userStore, jwtManager, service.NewInMemoryRevocationStore(), service.NewLoginLimiter(service.DefaultLoginLimits), nil)
+
+	user, err := service.NewUser("alice", "correct-horse-battery", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	login, err := server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "correct-horse-battery"})
+	require.NoError(t, err)
+
+	// a stolen token replayed at the same time as the real one
+	var refreshed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+			if err == nil {
+				atomic.AddInt32(&refreshed, 1)
+				return
+			}
+			require.Equal(t, codes.Unauthenticated, status.Code(err))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), refreshed)
+}
+
+func TestServerLoginLimits(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	loginLimiter := service.NewLoginLimiter(service.LoginLimits{
+		FreeFailures:        1,
+		PeerFreeFailures:    3,
+		BaseDelay:           time.Hour,
+		MaxDelay:            time.Hour,
+		LockoutFailures:     3,
+		PeerLockoutFailures: 4,
+		LockoutDuration:     time.Hour,
+	})
+	server := service.NewAuthServer(userStore, service.NewJWTManager("secret", time.Minute, time.Hour),
+		service.NewInMemoryRevocationStore(), loginLimiter, nil)
+	adminServer := service.NewUserAdminServer(userStore, service.NewInMemoryTenantStore(), loginLimiter, []string{"admin", "user"})
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		user, err := service.NewUser(username, username+"-long-secret", "user")
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+	}
+
+	fromIP := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242}})
+	}
+	login := func(ctx context.Context, username, password string) codes.Code {
+		_, err := server.Login(ctx, &pb.LoginRequest{Username: username, Password: password})
+		return status.Code(err)
+	}
+
+	// an unknown user and a wrong password look the same
+	require.Equal(t, codes.Unauthenticated, login(fromIP("10.0.0.1"), "nobody", "whatever-secret"))
+	require.Equal(t, codes.Unauthenticated, login(fromIP("10.0.0.2"), "alice", "wrong-secret"))
+
+	// the second failure delays the next try, even with the right password
+	require.Equal(t, codes.Unauthenticated, login(fromIP("10.0.0.3"), "alice", "wrong-secret"))
+	require.Equal(t, codes.ResourceExhausted, login(fromIP("10.0.0.4"), "alice", "alice-long-secret"))
+	require.Equal(t, codes.OK, login(fromIP("10.0.0.4"), "bob", "bob-long-secret"))
+
+	adminCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "root", Role: "admin"})
+	_, err := adminServer.UnlockUser(adminCtx, &pb.UnlockUserRequest{Username: "alice"})
+	require.NoError(t, err)
+	require.Equal(t, codes.OK, login(fromIP("10.0.0.4"), "alice", "alice-long-secret"))
+
+	// guessing many accounts from one IP blocks the IP
+	attacker := fromIP("10.0.0.66")
+	require.Equal(t, codes.Unauthenticated, login(attacker, "alice", "guess-1-secret"))
+	require.Equal(t, codes.Unauthenticated, login(attacker, "bob", "guess-2-secret"))
+	require.Equal(t, codes.Unauthenticated, login(attacker, "carol", "guess-3-secret"))
+	require.Equal(t, codes.Unauthenticated, login(attacker, "dave", "guess-4-secret"))
+	require.Equal(t, codes.ResourceExhausted, login(attacker, "erin", "guess-5-secret"))
+	require.Equal(t, codes.OK, login(fromIP("10.0.0.5"), "carol", "carol-long-secret"))
+}
+
+func TestServerParallelLoginGuesses(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	server := service.NewAuthServer(userStore, service.NewJWTManager("secret", time.Minute, time.Hour),
+		service.NewInMemoryRevocationStore(), service.NewLoginLimiter(service.LoginLimits{
+			FreeFailures:        1,
+			PeerFreeFailures:    100,
+			BaseDelay:           time.Hour,
+			MaxDelay:            time.Hour,
+			LockoutFailures:     10,
+			PeerLockoutFailures: 100,
+			LockoutDuration:     time.Hour,
+		}), nil)
+
+	user, err := service.NewUser("alice", "alice-long-secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	// the guesses all start before the first one fails
+	var guessed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "guess-secret"})
+			if status.Code(err) == codes.Unauthenticated {
+				atomic.AddInt32(&guessed, 1)
+				return
+			}
+			require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), guessed)
+}
+
+func TestServerOIDCLogin(t *testing.T) {
+	t.Parallel()
+
+	idp, err := oidctest.NewProvider("pcbook", "pcbook-secret")
+	require.NoError(t, err)
+	defer idp.Close()
+
+	oidcProvider, err := service.NewOIDCProvider(context.Background(), service.OIDCConfig{
+		IssuerURL:    idp.Issuer(),
+		ClientID:     "pcbook",
+		ClientSecret: "pcbook-secret",
+		RedirectURL:  "http://localhost:8081/v1/auth/oidc/callback",
+		Roles: []service.OIDCRole{
+			{Group: "pcbook-admins", Role: "admin"},
+			{Group: "employees", Role: "user"},
+		},
+	})
+	require.NoError(t, err)
+
+	userStore := service.NewInMemoryUserStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	server := service.NewAuthServer(userStore, jwtManager, service.NewInMemoryRevocationStore(),
+		service.NewLoginLimiter(service.DefaultLoginLimits), oidcProvider)
+
+	local, err := service.NewUser("bob", "bob-long-secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(local))
+
+	login := func(claims map[string]interface{}) (*pb.FinishOIDCLoginResponse, error) {
+		idp.SignIn(claims)
+		start, err := server.StartOIDCLogin(context.Background(), &pb.StartOIDCLoginRequest{})
+		require.NoError(t, err)
+		code, state, err := idp.Authorize(start.GetAuthorizationUrl())
+		require.NoError(t, err)
+		require.Equal(t, start.GetState(), state)
+		return server.FinishOIDCLogin(context.Background(), &pb.FinishOIDCLoginRequest{Code: code, State: state})
+	}
+
+	res, err := login(map[string]interface{}{
+		"sub":                "1001",
+		"preferred_username": "alice",
+		"groups":             []string{"employees", "pcbook-admins"},
+	})
+	require.NoError(t, err)
+	claims, err := jwtManager.Verify(res.GetAccessToken())
+	require.NoError(t, err)
+	require.Equal(t, "alice", claims.Username)
+	require.Equal(t, "admin", claims.Role)
+
+	// the role follows the groups of the provider
+	res, err = login(map[string]interface{}{"sub": "1001", "preferred_username": "alice", "groups": "employees"})
+	require.NoError(t, err)
+	claims, err = jwtManager.Verify(res.GetAccessToken())
+	require.NoError(t, err)
+	require.Equal(t, "user", claims.Role)
+
+	// the OIDC account has no password
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: ""})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = login(map[string]interface{}{"sub": "1002", "preferred_username": "carol", "groups": "contractors"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// a provider user cant take over a local account
+	_, err = login(map[string]interface{}{"sub": "1003", "preferred_username": "bob", "groups": "employees"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// a state is only used once
+	idp.SignIn(map[string]interface{}{"sub": "1001", "preferred_username": "alice", "groups": "employees"})
+	start, err := server.StartOIDCLogin(context.Background(), &pb.StartOIDCLoginRequest{})
+	require.NoError(t, err)
+	code, state, err := idp.Authorize(start.GetAuthorizationUrl())
+	require.NoError(t, err)
+	_, err = server.FinishOIDCLogin(context.Background(), &pb.FinishOIDCLoginRequest{Code: code, State: state})
+	require.NoError(t, err)
+	_, err = server.FinishOIDCLogin(context.Background(), &pb.FinishOIDCLoginRequest{Code: code, State: state})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a flood of started logins drops the oldest ones
+	start, err = server.StartOIDCLogin(context.Background(), &pb.StartOIDCLoginRequest{})
+	require.NoError(t, err)
+	code, state, err = idp.Authorize(start.GetAuthorizationUrl())
+	require.NoError(t, err)
+	for i := 0; i < service.MaxPendingOIDCLogins; i++ {
+		_, err = server.StartOIDCLogin(context.Background(), &pb.StartOIDCLoginRequest{})
+		require.NoError(t, err)
+	}
+	_, err = server.FinishOIDCLogin(context.Background(), &pb.FinishOIDCLoginRequest{Code: code, State: state})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = login(map[string]interface{}{"sub": "1001", "preferred_username": "alice", "groups": "employees"})
+	require.NoError(t, err)
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	// hashing at the default cost makes the auth tests take seconds
+	passwordCost = bcrypt.MinCost
+	// the watch tests wait for the resume token sent alone
+	resumeTokenInterval = 10 * time.Millisecond
+}
+
+// SweepAt runs the sweep of the idle buckets as if it were due at now, and
+// returns the number of buckets left.
+func (l *RateLimiter) SweepAt(now time.Time) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.lastSweep = time.Time{}
+	l.sweep(now)
+	return len(l.buckets)
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// GatewayPeerInterceptor makes the HTTP client the peer of the calls coming
+// from the REST gateway, so that the login limits and the audit log see its
+// address instead of the gateway one. The gateway appends the client IP to
+// x-forwarded-for, only the last entry is trusted. Install it only on a
+// server the gateway alone can reach.
+type GatewayPeerInterceptor struct{}
+
+func (i GatewayPeerInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		return handler(contextWithForwardedPeer(ctx), req)
+	}
+}
+
+func (i GatewayPeerInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(server interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		return handler(server, &serverStreamWithContext{
+			ServerStream: stream,
+			ctx:          contextWithForwardedPeer(stream.Context()),
+		})
+	}
+}
+
+func contextWithForwardedPeer(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	forwarded := md["x-forwarded-for"]
+	if len(forwarded) == 0 {
+		return ctx
+	}
+
+	hops := strings.Split(forwarded[len(forwarded)-1], ",")
+	ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1]))
+	if ip == nil {
+		return ctx
+	}
+
+	p, _ := peer.FromContext(ctx)
+	forwardedPeer := &peer.Peer{Addr: &net.IPAddr{IP: ip}}
+	if p != nil {
+		forwardedPeer.AuthInfo = p.AuthInfo
+	}
+	return peer.NewContext(ctx, forwardedPeer)
+}
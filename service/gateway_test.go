@@ -0,0 +1,42 @@
+package service_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestGatewayPeerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	gatewayPeer := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}}
+	call := func(forwardedFor ...string) string {
+		ctx := peer.NewContext(context.Background(), gatewayPeer)
+		if len(forwardedFor) > 0 {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", forwardedFor[0]))
+		}
+
+		var addr string
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.AuthService/Login"}
+		_, err := service.GatewayPeerInterceptor{}.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			p, ok := peer.FromContext(ctx)
+			require.True(t, ok)
+			addr = p.Addr.String()
+			return nil, nil
+		})
+		require.NoError(t, err)
+		return addr
+	}
+
+	require.Equal(t, "127.0.0.1:4242", call())
+	require.Equal(t, "10.1.2.3", call("10.1.2.3"))
+	// the client can send its own header, the gateway appends the real IP
+	require.Equal(t, "10.1.2.3", call("6.6.6.6, 10.1.2.3"))
+	require.Equal(t, "127.0.0.1:4242", call("not-an-ip"))
+}
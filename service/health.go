@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthCheck tells if a dependency works, such as a store. The services
+// are reported NOT_SERVING while it fails.
+type HealthCheck struct {
+	Name     string
+	Services []string
+	Check    func(ctx context.Context) error
+}
+
+// HealthChecker runs the checks and reports the result on the standard
+// grpc.health.v1 service, per service and for the whole server ("").
+type HealthChecker struct {
+	server   *health.Server
+	services []string
+	checks   []HealthCheck
+
+	mutex    sync.RWMutex
+	failures map[string]string
+	draining bool
+}
+
+func NewHealthChecker(services []string, checks []HealthCheck) *HealthChecker {
+	checker := &HealthChecker{
+		server:   health.NewServer(),
+		services: services,
+		checks:   checks,
+		failures: make(map[string]string),
+	}
+	for _, service := range services {
+		checker.server.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	return checker
+}
+
+// Server is the grpc.health.v1 service to register.
+func (c *HealthChecker) Server() healthpb.HealthServer {
+	return c.server
+}
+
+// Update runs the checks once and sets the statuses.
+func (c *HealthChecker) Update(ctx context.Context) {
+	failures := make(map[string]string)
+	down := make(map[string]bool)
+	for _, check := range c.checks {
+		err := check.Check(ctx)
+		if err != nil {
+			failures[check.Name] = err.Error()
+			for _, service := range check.Services {
+				down[service] = true
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for name, failure := range failures {
+		if _, failed := c.failures[name]; !failed {
+			slog.Warn("health check failed", "check", name, "error", failure)
+		}
+	}
+	for name := range c.failures {
+		if _, failed := failures[name]; !failed {
+			slog.Info("health check recovered", "check", name)
+		}
+	}
+	c.failures = failures
+
+	if c.draining {
+		return
+	}
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	for _, service := range c.services {
+		status := healthpb.HealthCheckResponse_SERVING
+		if down[service] {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			overall = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		c.server.SetServingStatus(service, status)
+	}
+	c.server.SetServingStatus("", overall)
+}
+
+// Run updates the statuses every interval until ctx is done.
+func (c *HealthChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.Update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drain reports every service NOT_SERVING for good, so that the load
+// balancers stop sending calls before the server stops.
+func (c *HealthChecker) Drain() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.draining = true
+	c.server.Shutdown()
+}
+
+// Ready tells if the server takes calls, and else why not.
+func (c *HealthChecker) Ready() (bool, map[string]string) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	failures := make(map[string]string)
+	for name, failure := range c.failures {
+		failures[name] = failure
+	}
+	if c.draining {
+		failures["server"] = "draining"
+	}
+	return len(failures) == 0, failures
+}
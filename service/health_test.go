@@ -0,0 +1,64 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthChecker(t *testing.T) {
+	t.Parallel()
+
+	folder := filepath.Join(t.TempDir(), "img")
+	imageStore := service.NewDiskImageStore(folder)
+	var storeErr error
+
+	checker := service.NewHealthChecker([]string{"pb.LaptopService", "pb.AuthService"}, []service.HealthCheck{
+		{Name: "image_store", Services: []string{"pb.LaptopService"}, Check: imageStore.Check},
+		{Name: "database", Services: []string{"pb.LaptopService"}, Check: func(ctx context.Context) error {
+			return storeErr
+		}},
+	})
+
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := checker.Server().Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return res.GetStatus()
+	}
+
+	checker.Update(context.Background())
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, status(""))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, status("pb.LaptopService"))
+	ready, failures := checker.Ready()
+	require.True(t, ready)
+	require.Empty(t, failures)
+	entries, err := os.ReadDir(folder)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	storeErr = errors.New("connection refused")
+	checker.Update(context.Background())
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status(""))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status("pb.LaptopService"))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, status("pb.AuthService"))
+	ready, failures = checker.Ready()
+	require.False(t, ready)
+	require.Equal(t, map[string]string{"database": "connection refused"}, failures)
+
+	storeErr = nil
+	checker.Update(context.Background())
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, status("pb.LaptopService"))
+
+	checker.Drain()
+	checker.Update(context.Background())
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status(""))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status("pb.AuthService"))
+	ready, _ = checker.Ready()
+	require.False(t, ready)
+}
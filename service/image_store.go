@@ -2,27 +2,52 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrInvalidImageType = errors.New("invalid image type")
+
+	imageTypePattern = regexp.MustCompile(`^\.(jpg|jpeg|png|gif|webp)$`)
+)
+
+// ValidateImageType accepts the extensions of the usual web image formats.
+// The type ends the file name of the image.
+func ValidateImageType(imageType string) error {
+	if !imageTypePattern.MatchString(imageType) {
+		return fmt.Errorf("%w %q: use .jpg, .jpeg, .png, .gif or .webp", ErrInvalidImageType, imageType)
+	}
+	return nil
+}
+
+// ImageStore keeps the laptop images, scoped by the tenant of the caller
+// like LaptopStore.
 type ImageStore interface {
-	Save(laptopID string, imageType string, imageData bytes.Buffer) (id string, err error)
+	Save(ctx context.Context, laptopID string, imageType string, imageData bytes.Buffer) (id string, err error)
 }
 
 type DiskImageStore struct {
 	imageFolder string
 	images      map[string]*ImageInfo
+	bytes       int64
 	mutex       sync.RWMutex
 }
 
 type ImageInfo struct {
+	Tenant   string
 	LaptopID string
 	Type     string
 	Path     string
+	Size     int64
 }
 
 func NewDiskImageStore(folder string) *DiskImageStore {
@@ -32,24 +57,39 @@ func NewDiskImageStore(folder string) *DiskImageStore {
 	}
 }
 
-func (s *DiskImageStore) Save(laptopID string, imageType string, imageData bytes.Buffer) (id string, err error) {
+// Save writes the images of the default tenant in the image folder, and
+// those of another tenant in a sub folder named after it.
+func (s *DiskImageStore) Save(ctx context.Context, laptopID string, imageType string, imageData bytes.Buffer) (id string, err error) {
+	err = ValidateImageType(imageType)
+	if err != nil {
+		return "", err
+	}
+
 	imageID, err := uuid.NewRandom()
 	if err != nil {
 		return "", fmt.Errorf("cant not create uuid %w", err)
 	}
 
-	imagePath := fmt.Sprintf("./%s/%s%s", s.imageFolder, imageID.String(), imageType)
+	tenant := TenantFromContext(ctx)
+	folder := filepath.Join(s.imageFolder, tenant)
+	imagePath := filepath.Join(folder, imageID.String()+imageType)
+	rel, err := filepath.Rel(s.imageFolder, imagePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("image path %v is outside the image folder", imagePath)
+	}
+
 	file, err := os.Create(imagePath)
 	if err != nil {
-		_, err = os.Stat("./img")
-		if os.IsNotExist(err) {
-			os.MkdirAll("../../img", 0755)
+		err = os.MkdirAll(folder, 0755)
+		if err != nil {
+			return "", fmt.Errorf("cant not create folder %w", err)
 		}
 		file, err = os.Create(imagePath)
 		if err != nil {
 			return "", fmt.Errorf("cant not create file %w", err)
 		}
 	}
+	defer file.Close()
 
 	writenBytes, err := imageData.WriteTo(file)
 	if err != nil {
@@ -59,10 +99,36 @@ func (s *DiskImageStore) Save(laptopID string, imageType string, imageData bytes
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.images[imageID.String()] = &ImageInfo{
+		Tenant:   tenant,
 		LaptopID: laptopID,
 		Type:     imageType,
 		Path:     imagePath,
+		Size:     writenBytes,
 	}
+	s.bytes += writenBytes
 
 	return imageID.String(), nil
 }
+
+// Bytes returns the size of the images saved by the store.
+func (s *DiskImageStore) Bytes() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.bytes
+}
+
+// Check tells if images can be written in the image folder.
+func (s *DiskImageStore) Check(ctx context.Context) error {
+	err := os.MkdirAll(s.imageFolder, 0755)
+	if err != nil {
+		return fmt.Errorf("cant create image folder: %w", err)
+	}
+
+	file, err := os.CreateTemp(s.imageFolder, ".health-*")
+	if err != nil {
+		return fmt.Errorf("image folder is not writable: %w", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
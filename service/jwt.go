@@ -2,59 +2,183 @@ package service
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+const (
+	AccessTokenType  = "access"
+	RefreshTokenType = "refresh"
 )
 
 type JWTManager struct {
-	secretKey     string
-	tokenDuration time.Duration
+	// secretKey signs with HS256 when there is no signing key
+	secretKey            string
+	tokenDuration        time.Duration
+	refreshTokenDuration time.Duration
+
+	mutex            sync.RWMutex
+	signingKey       *SigningKey
+	verificationKeys map[string]*VerificationKey
 }
 
 type UserClaims struct {
 	jwt.StandardClaims
 	Username string
-	Role     string
+	// UserID keeps the tokens of a deleted user from working for a new
+	// user with the same name.
+	UserID    string
+	Role      string
+	TokenType string
+	// Organization and Tenant are refreshed from the user store on every call.
+	Organization string `json:",omitempty"`
+	Tenant       string `json:",omitempty"`
 }
 
 func (claims *UserClaims) IsValid() bool {
-	return claims.Valid() == nil && len(claims.Role) != 0 && len(claims.Username) != 0
+	return claims.Valid() == nil && len(claims.Role) != 0 && len(claims.Username) != 0 && len(claims.Id) != 0
+}
+
+// ExpiresTime returns when the token stops being valid.
+func (claims *UserClaims) ExpiresTime() time.Time {
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+func NewJWTManager(privKey string, expire, refreshExpire time.Duration) *JWTManager {
+	return &JWTManager{
+		secretKey:            privKey,
+		tokenDuration:        expire,
+		refreshTokenDuration: refreshExpire,
+	}
+}
+
+// NewAsymmetricJWTManager signs tokens with signingKey and accepts tokens
+// signed by it or by any of the extra verificationKeys, for example the
+// keys being rotated out.
+func NewAsymmetricJWTManager(signingKey *SigningKey,
+	verificationKeys []*VerificationKey,
+	expire, refreshExpire time.Duration) *JWTManager {
+	manager := &JWTManager{
+		tokenDuration:        expire,
+		refreshTokenDuration: refreshExpire,
+		signingKey:           signingKey,
+		verificationKeys:     make(map[string]*VerificationKey),
+	}
+
+	for _, key := range verificationKeys {
+		manager.verificationKeys[key.KeyID] = key
+	}
+	manager.verificationKeys[signingKey.KeyID] = signingKey.VerificationKey()
+
+	return manager
 }
 
-func NewJWTManager(privKey string, expire time.Duration) *JWTManager {
-	return &JWTManager{privKey, expire}
+// RotateSigningKey signs new tokens with key. The previous key keeps
+// verifying the tokens it signed until RemoveVerificationKey is called.
+func (j *JWTManager) RotateSigningKey(key *SigningKey) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.verificationKeys == nil {
+		j.verificationKeys = make(map[string]*VerificationKey)
+	}
+	j.signingKey = key
+	j.verificationKeys[key.KeyID] = key.VerificationKey()
+}
+
+// RemoveVerificationKey stops accepting tokens signed with the key.
+// The current signing key cant be removed.
+func (j *JWTManager) RemoveVerificationKey(keyID string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.signingKey != nil && j.signingKey.KeyID == keyID {
+		return fmt.Errorf("key %v is the current signing key", keyID)
+	}
+	delete(j.verificationKeys, keyID)
+	return nil
 }
 
+// JWKS returns the public keys tokens are verified with. It is empty for a
+// manager signing with a shared secret.
+func (j *JWTManager) JWKS() *JSONWebKeySet {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range j.verificationKeys {
+		set.Keys = append(set.Keys, key.JSONWebKey())
+	}
+	sort.Slice(set.Keys, func(a, b int) bool {
+		return set.Keys[a].KeyID < set.Keys[b].KeyID
+	})
+
+	return set
+}
+
+// Generate returns a short lived access token for the user.
 func (j *JWTManager) Generate(user *User) (string, error) {
+	return j.generate(user, AccessTokenType, j.tokenDuration)
+}
+
+// GenerateRefresh returns a long lived token that can only be traded for a
+// new access token.
+func (j *JWTManager) GenerateRefresh(user *User) (string, error) {
+	return j.generate(user, RefreshTokenType, j.refreshTokenDuration)
+}
+
+func (j *JWTManager) generate(user *User, tokenType string, duration time.Duration) (string, error) {
+	jti, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cant create token id: %w", err)
+	}
+
+	now := time.Now()
 	claims := UserClaims{
 		jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(j.tokenDuration).Unix(),
+			Id:        jti.String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(duration).Unix(),
 		},
 		user.UserName,
+		user.ID,
 		user.Role,
+		tokenType,
+		user.Organization,
+		user.Tenant,
 	}
 
-	// TODO: change to RSA or Elliptic-Curve based Digital signature
-	tokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	j.mutex.RLock()
+	signingKey := j.signingKey
+	j.mutex.RUnlock()
 
-	return tokenObj.SignedString([]byte(j.secretKey))
+	if signingKey == nil {
+		tokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return tokenObj.SignedString([]byte(j.secretKey))
+	}
+
+	tokenObj := jwt.NewWithClaims(signingKey.Method, claims)
+	tokenObj.Header["kid"] = signingKey.KeyID
+	return tokenObj.SignedString(signingKey.PrivateKey)
 }
 
+// Verify checks an access token.
 func (j *JWTManager) Verify(token string) (*UserClaims, error) {
-	claims := &UserClaims{}
-	_, err := jwt.ParseWithClaims(token,
-		claims,
-		func(t *jwt.Token) (interface{}, error) {
-			_, ok := t.Method.(*jwt.SigningMethodHMAC)
-			if !ok {
-				return nil, fmt.Errorf("got wrong algo, actually got %v", t.Method.Alg())
-			}
-
-			return []byte(j.secretKey), nil
-		},
-	)
+	return j.verify(token, AccessTokenType)
+}
+
+// VerifyRefresh checks a refresh token.
+func (j *JWTManager) VerifyRefresh(token string) (*UserClaims, error) {
+	return j.verify(token, RefreshTokenType)
+}
 
+func (j *JWTManager) verify(token string, tokenType string) (*UserClaims, error) {
+	claims := &UserClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, j.keyFunc)
 	if err != nil {
 		return nil, fmt.Errorf("invalid token with err: %w", err)
 	}
@@ -63,5 +187,36 @@ func (j *JWTManager) Verify(token string) (*UserClaims, error) {
 		return nil, fmt.Errorf("invalid info of token %v", claims)
 	}
 
+	if claims.TokenType != tokenType {
+		return nil, fmt.Errorf("got %v token, expect %v token", claims.TokenType, tokenType)
+	}
+
 	return claims, nil
 }
+
+// keyFunc picks the key by the kid header. The algorithm must be the one of
+// the key, a token cant choose how it is verified.
+func (j *JWTManager) keyFunc(t *jwt.Token) (interface{}, error) {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	if j.verificationKeys == nil {
+		_, ok := t.Method.(*jwt.SigningMethodHMAC)
+		if !ok {
+			return nil, fmt.Errorf("got wrong algo, actually got %v", t.Method.Alg())
+		}
+		return []byte(j.secretKey), nil
+	}
+
+	keyID, _ := t.Header["kid"].(string)
+	key, ok := j.verificationKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", keyID)
+	}
+
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("got wrong algo, actually got %v", t.Method.Alg())
+	}
+
+	return key.PublicKey, nil
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SigningKey is the private key new tokens are signed with.
+type SigningKey struct {
+	KeyID      string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+}
+
+// VerificationKey is a public key tokens are accepted from.
+type VerificationKey struct {
+	KeyID     string
+	Method    jwt.SigningMethod
+	PublicKey crypto.PublicKey
+}
+
+// JSONWebKey is the public part of a VerificationKey, as defined by RFC 7517.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// LoadSigningKey reads a PEM encoded RSA or ECDSA private key. RSA keys sign
+// with RS256, ECDSA keys with ES256, ES384 or ES512 depending on the curve.
+func LoadSigningKey(path string, keyID string) (*SigningKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant parse private key %v: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T in %v", key, path)
+	}
+
+	method, err := signingMethodFor(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return &SigningKey{KeyID: keyID, Method: method, PrivateKey: signer}, nil
+}
+
+// LoadVerificationKey reads a PEM encoded public key, certificate or
+// private key and keeps its public part.
+func LoadVerificationKey(path string, keyID string) (*VerificationKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var publicKey crypto.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			publicKey = cert.PublicKey
+		}
+	default:
+		var signingKey *SigningKey
+		signingKey, err = LoadSigningKey(path, keyID)
+		if err == nil {
+			return signingKey.VerificationKey(), nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant parse public key %v: %w", path, err)
+	}
+
+	method, err := signingMethodFor(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return &VerificationKey{KeyID: keyID, Method: method, PublicKey: publicKey}, nil
+}
+
+// VerificationKey returns the public half of the signing key.
+func (k *SigningKey) VerificationKey() *VerificationKey {
+	return &VerificationKey{KeyID: k.KeyID, Method: k.Method, PublicKey: k.PrivateKey.Public()}
+}
+
+// JSONWebKey returns the key in JWK format.
+func (k *VerificationKey) JSONWebKey() JSONWebKey {
+	jwk := JSONWebKey{KeyID: k.KeyID, Use: "sig", Algorithm: k.Method.Alg()}
+
+	switch key := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64URL(key.N.Bytes())
+		jwk.E = base64URL(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = key.Curve.Params().Name
+		jwk.X = base64URL(key.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64URL(key.Y.FillBytes(make([]byte, size)))
+	}
+
+	return jwk
+}
+
+func signingMethodFor(publicKey crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported curve %v", key.Curve.Params().Name)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", publicKey)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %v", path)
+	}
+
+	return block, nil
+}
+
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
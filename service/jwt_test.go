@@ -0,0 +1,99 @@
+package service_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	require.NoError(t, err)
+
+	return path
+}
+
+func TestJWTManagerAsymmetricKeys(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	oldKey, err := service.LoadSigningKey(writeKeyFile(t, rsaKey), "old")
+	require.NoError(t, err)
+	require.Equal(t, "RS256", oldKey.Method.Alg())
+
+	newKey, err := service.LoadSigningKey(writeKeyFile(t, ecKey), "new")
+	require.NoError(t, err)
+	require.Equal(t, "ES256", newKey.Method.Alg())
+
+	user := &service.User{UserName: "alice", Role: "user"}
+	manager := service.NewAsymmetricJWTManager(oldKey, nil, time.Minute, time.Hour)
+
+	oldToken, err := manager.Generate(user)
+	require.NoError(t, err)
+
+	// tokens signed before the rotation stay valid
+	manager.RotateSigningKey(newKey)
+	newToken, err := manager.Generate(user)
+	require.NoError(t, err)
+
+	for _, token := range []string{oldToken, newToken} {
+		claims, err := manager.Verify(token)
+		require.NoError(t, err)
+		require.Equal(t, "alice", claims.Username)
+	}
+
+	parsed, _, err := new(jwt.Parser).ParseUnverified(newToken, &service.UserClaims{})
+	require.NoError(t, err)
+	require.Equal(t, "new", parsed.Header["kid"])
+
+	jwks := manager.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, "RSA", jwks.Keys[1].KeyType)
+	require.Equal(t, "EC", jwks.Keys[0].KeyType)
+	require.Equal(t, "P-256", jwks.Keys[0].Curve)
+
+	require.Error(t, manager.RemoveVerificationKey("new"))
+	require.NoError(t, manager.RemoveVerificationKey("old"))
+	_, err = manager.Verify(oldToken)
+	require.Error(t, err)
+
+	// the public key file describes the same JWK
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	require.NoError(t, err)
+	publicPath := filepath.Join(t.TempDir(), "public.pem")
+	err = os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	require.NoError(t, err)
+	publicKey, err := service.LoadVerificationKey(publicPath, "new")
+	require.NoError(t, err)
+	require.Equal(t, jwks.Keys[0], publicKey.JSONWebKey())
+
+	// the token cant pick another algorithm for a known key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, parsed.Claims)
+	forged.Header["kid"] = "new"
+	forgedToken, err := forged.SignedString([]byte("guess"))
+	require.NoError(t, err)
+	_, err = manager.Verify(forgedToken)
+	require.Error(t, err)
+
+	// HS256 managers publish no key
+	require.Empty(t, service.NewJWTManager("secret", time.Minute, time.Hour).JWKS().Keys)
+}
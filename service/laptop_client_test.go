@@ -2,6 +2,7 @@ package service_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -16,7 +17,9 @@ import (
 	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -44,13 +47,25 @@ func TestClientCreateLaptop(t *testing.T) {
 	require.NotNil(t, laptopFromBD)
 
 	// Must use proto.Equal because inside pb.Laptop struct has internal fields (IE sizeCache)
+	laptop.Owner = "root"
 	require.True(t, proto.Equal(laptopFromBD, laptop))
 
 }
 
 func startTestLaptopServer(laptopStore service.LaptopStore, imageStore service.ImageStore, ratingStore service.RatingStore) (server *service.LaptopServer, address string, err error) {
 	server = service.NewLaptopServer(laptopStore, imageStore, ratingStore)
-	gprcServer := grpc.NewServer()
+	// the calls are made by a super admin, owners are tested in TestServerLaptopOwnership
+	claims := &service.UserClaims{Username: "root", Role: service.SuperAdminRole}
+	gprcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return handler(service.ContextWithUserClaims(ctx, claims), req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream,
+			info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, &claimsServerStream{stream, service.ContextWithUserClaims(stream.Context(), claims)})
+		}),
+	)
 	pb.RegisterLaptopServiceServer(gprcServer, server)
 
 	lis, err := net.Listen("tcp", ":0")
@@ -64,6 +79,15 @@ func startTestLaptopServer(laptopStore service.LaptopStore, imageStore service.I
 	return server, lis.Addr().String(), nil
 }
 
+type claimsServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *claimsServerStream) Context() context.Context {
+	return s.ctx
+}
+
 func newClientLaptop(address string) (pb.LaptopServiceClient, error) {
 	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -220,3 +244,202 @@ func TestUploadImage(t *testing.T) {
 	log.Printf("receive id %v and size %v from server reponse", res.Id, res.Size)
 
 }
+
+func TestUploadImageInvalidType(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	root := t.TempDir()
+	imageFolder := filepath.Join(root, "img")
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(imageFolder)
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(ctx, laptop))
+
+	_, addr, err := startTestLaptopServer(laptopStore, imageStore, nil)
+	require.NoError(t, err)
+	client, err := newClientLaptop(addr)
+	require.NoError(t, err)
+
+	for _, imageType := range []string{"/../../escaped.txt", "/../../escaped.png", ".png/../../x", ".exe", ""} {
+		stream, err := client.UploadImage(ctx)
+		require.NoError(t, err)
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_Info{
+				Info: &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: imageType},
+			},
+		})
+		if err == nil {
+			err = stream.Send(&pb.UploadImageRequest{
+				Data: &pb.UploadImageRequest_ChunkData{ChunkData: []byte("not an image")},
+			})
+		}
+		if err == nil || err == io.EOF {
+			_, err = stream.CloseAndRecv()
+		}
+		require.Equal(t, codes.InvalidArgument, status.Code(err), imageType)
+	}
+
+	// the store refuses them too
+	_, err = imageStore.Save(ctx, laptop.GetId(), "/../../escaped.png", *bytes.NewBufferString("not an image"))
+	require.ErrorIs(t, err, service.ErrInvalidImageType)
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("file %v written", path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	require.Zero(t, imageStore.Bytes())
+}
+
+func TestClientWatchLaptops(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filter := &pb.Filter{
+		MaxPriceUsd: 2000,
+		MinCpuCores: 4,
+		MinCpuGhz:   2.2,
+		MinRam:      &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE},
+	}
+	qualify := func(laptop *pb.Laptop) *pb.Laptop {
+		laptop.PriceUsd = 1500
+		laptop.Cpu.NumberCores = 4
+		laptop.Cpu.MinGhz = 2.5
+		laptop.Ram = &pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE}
+		return laptop
+	}
+
+	store := service.NewInMemoryLaptopStore()
+	existing := qualify(sample.NewLaptop())
+	require.NoError(t, store.Save(ctx, existing))
+
+	_, address, err := startTestLaptopServer(store, nil, nil)
+	require.NoError(t, err)
+
+	client, err := newClientLaptop(address)
+	require.NoError(t, err)
+
+	stream, err := client.WatchLaptops(ctx, &pb.WatchLaptopsRequest{Filter: filter})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchLaptopsResponse_EXISTING, res.GetEvent())
+	require.Equal(t, existing.Id, res.GetLaptop().GetId())
+	require.NotEmpty(t, res.GetResumeToken())
+
+	created := qualify(sample.NewLaptop())
+	_, err = client.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: created})
+	require.NoError(t, err)
+
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchLaptopsResponse_CREATED, res.GetEvent())
+	require.Equal(t, created.Id, res.GetLaptop().GetId())
+	createdToken := res.GetResumeToken()
+
+	// leaving the filter is a delete for the watcher
+	expensive := proto.Clone(created).(*pb.Laptop)
+	expensive.PriceUsd = 5000
+	_, err = client.UpdateLaptop(ctx, &pb.UpdateLaptopRequest{Laptop: expensive})
+	require.NoError(t, err)
+
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchLaptopsResponse_DELETED, res.GetEvent())
+	require.Equal(t, created.Id, res.GetLaptop().GetId())
+
+	_, err = client.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: existing.Id})
+	require.NoError(t, err)
+
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchLaptopsResponse_DELETED, res.GetEvent())
+	require.Equal(t, existing.Id, res.GetLaptop().GetId())
+
+	// a resumed watch replays what happened after the token, no snapshot
+	resumed, err := client.WatchLaptops(ctx, &pb.WatchLaptopsRequest{
+		Filter:      filter,
+		ResumeToken: createdToken,
+	})
+	require.NoError(t, err)
+
+	for _, id := range []string{created.Id, existing.Id} {
+		res, err = resumed.Recv()
+		require.NoError(t, err)
+		require.Equal(t, pb.WatchLaptopsResponse_DELETED, res.GetEvent())
+		require.Equal(t, id, res.GetLaptop().GetId())
+	}
+
+	expired, err := client.WatchLaptops(ctx, &pb.WatchLaptopsRequest{
+		Filter:      filter,
+		ResumeToken: "1000000",
+	})
+	require.NoError(t, err)
+	_, err = expired.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func TestClientWatchLaptopsResumeTokenOnly(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filter := &pb.Filter{MaxPriceUsd: 1000}
+
+	store := service.NewInMemoryLaptopStore()
+	_, address, err := startTestLaptopServer(store, nil, nil)
+	require.NoError(t, err)
+
+	client, err := newClientLaptop(address)
+	require.NoError(t, err)
+
+	stream, err := client.WatchLaptops(ctx, &pb.WatchLaptopsRequest{Filter: filter})
+	require.NoError(t, err)
+
+	// an empty snapshot still ends with a token
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchLaptopsResponse_UNKNOWN, res.GetEvent())
+	require.Nil(t, res.GetLaptop())
+	snapshotToken := res.GetResumeToken()
+	require.NotEmpty(t, snapshotToken)
+
+	// the filter drops it, the token moves on anyway
+	expensive := sample.NewLaptop()
+	expensive.PriceUsd = 5000
+	_, err = client.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: expensive})
+	require.NoError(t, err)
+
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchLaptopsResponse_UNKNOWN, res.GetEvent())
+	require.Nil(t, res.GetLaptop())
+	skippedToken := res.GetResumeToken()
+	require.NotEmpty(t, skippedToken)
+	require.NotEqual(t, snapshotToken, skippedToken)
+
+	cheap := sample.NewLaptop()
+	cheap.PriceUsd = 500
+	_, err = client.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: cheap})
+	require.NoError(t, err)
+
+	// resuming from it gets the next matching laptop and nothing before
+	resumed, err := client.WatchLaptops(ctx, &pb.WatchLaptopsRequest{
+		Filter:      filter,
+		ResumeToken: skippedToken,
+	})
+	require.NoError(t, err)
+
+	res, err = resumed.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchLaptopsResponse_CREATED, res.GetEvent())
+	require.Equal(t, cheap.Id, res.GetLaptop().GetId())
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	UploadImageFormPath = "/v1/laptop/upload_image/form"
+	RateLaptopsPath     = "/v1/laptop/rate/batch"
+
+	uploadChunkSize   = 64 << 10
+	maxRatingsBatch   = 1000
+	maxUploadFormSize = MaxChunkSize + 64<<10
+	// maxRatingsBodySize leaves room for maxRatingsBatch ratings, about
+	// 70 bytes each in JSON
+	maxRatingsBodySize = maxRatingsBatch * 256
+)
+
+// RegisterLaptopGatewayHandlers adds to the gateway the endpoints it cant
+// generate for the client streaming RPCs: a multipart/form-data image upload
+// feeding UploadImage, and a JSON batch of ratings sent on one RateLaptop
+// stream. Like the generated handlers they forward the headers matched by
+// mux as metadata.
+func RegisterLaptopGatewayHandlers(mux *runtime.ServeMux, client pb.LaptopServiceClient) error {
+	err := mux.HandlePath(http.MethodPost, UploadImageFormPath, func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		_, outbound := runtime.MarshalerForRequest(mux, r)
+		ctx, err := runtime.AnnotateContext(r.Context(), mux, r, "/pb.LaptopService/UploadImage",
+			runtime.WithHTTPPathPattern(UploadImageFormPath))
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadFormSize)
+		res, err := uploadImageForm(ctx, client, r)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+
+		runtime.ForwardResponseMessage(ctx, mux, outbound, w, r, res)
+	})
+	if err != nil {
+		return err
+	}
+
+	return mux.HandlePath(http.MethodPost, RateLaptopsPath, func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		inbound, outbound := runtime.MarshalerForRequest(mux, r)
+		ctx, err := runtime.AnnotateContext(r.Context(), mux, r, "/pb.LaptopService/RateLaptop",
+			runtime.WithHTTPPathPattern(RateLaptopsPath))
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+
+		req := &pb.RateLaptopsRequest{}
+		err = inbound.NewDecoder(http.MaxBytesReader(w, r.Body, maxRatingsBodySize)).Decode(req)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			runtime.HTTPError(ctx, mux, outbound, w, r, status.Errorf(codes.InvalidArgument, "too many ratings, at most %v", maxRatingsBatch))
+			return
+		}
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, status.Errorf(codes.InvalidArgument, "cant decode ratings: %v", err))
+			return
+		}
+
+		res, err := rateLaptops(ctx, client, req)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+
+		runtime.ForwardResponseMessage(ctx, mux, outbound, w, r, res)
+	})
+}
+
+// uploadImageForm streams the form to UploadImage. The laptop_id field must
+// come before the image file, whose extension is the image type unless an
+// image_type field is sent.
+func uploadImageForm(ctx context.Context, client pb.LaptopServiceClient, r *http.Request) (*pb.UploadImageResponse, error) {
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "expect a multipart/form-data body: %v", err)
+	}
+
+	info := &pb.ImageInfo{}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil, status.Errorf(codes.InvalidArgument, "form has no image file")
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "cant read form: %v", err)
+		}
+
+		switch part.FormName() {
+		case "laptop_id", "image_type":
+			value, err := io.ReadAll(io.LimitReader(part, 256))
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "cant read form field %v: %v", part.FormName(), err)
+			}
+			if part.FormName() == "laptop_id" {
+				info.LaptopId = string(value)
+			} else {
+				info.ImageType = string(value)
+			}
+		case "image":
+			if len(info.LaptopId) == 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "laptop_id must come before the image")
+			}
+			if len(info.ImageType) == 0 {
+				info.ImageType = filepath.Ext(part.FileName())
+			}
+			err = ValidateImageType(info.ImageType)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+			return uploadImage(ctx, client, info, part)
+		}
+	}
+}
+
+func uploadImage(ctx context.Context, client pb.LaptopServiceClient, info *pb.ImageInfo, image io.Reader) (*pb.UploadImageResponse, error) {
+	stream, err := client.UploadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_Info{Info: info}})
+	if err != nil {
+		// the server ended the call, CloseAndRecv gives its error
+		return stream.CloseAndRecv()
+	}
+
+	buffer := make([]byte, uploadChunkSize)
+	for {
+		n, err := image.Read(buffer)
+		if n > 0 {
+			sendErr := stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_ChunkData{ChunkData: buffer[:n]}})
+			if sendErr != nil {
+				return stream.CloseAndRecv()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, status.Errorf(codes.InvalidArgument, "image is too large, max size %v", MaxChunkSize)
+			}
+			return nil, status.Errorf(codes.InvalidArgument, "cant read image: %v", err)
+		}
+	}
+
+	return stream.CloseAndRecv()
+}
+
+// rateLaptops sends the ratings while reading the results, so a large batch
+// cant block on flow control.
+func rateLaptops(ctx context.Context, client pb.LaptopServiceClient, req *pb.RateLaptopsRequest) (*pb.RateLaptopsResponse, error) {
+	if len(req.GetRatings()) == 0 || len(req.GetRatings()) > maxRatingsBatch {
+		return nil, status.Errorf(codes.InvalidArgument, "expect 1 to %v ratings", maxRatingsBatch)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.RateLaptop(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for _, rating := range req.GetRatings() {
+			// on error Recv returns the status of the call
+			if stream.Send(rating) != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+
+	res := &pb.RateLaptopsResponse{}
+	for {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Results = append(res.Results, result)
+	}
+}
@@ -0,0 +1,168 @@
+package service_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/sample"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestGatewayStreamingEndpoints(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(imageFolder)
+	ratingStore := service.NewInMemoryRatingStore()
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+
+	_, address, err := startTestLaptopServer(laptopStore, imageStore, ratingStore)
+	require.NoError(t, err)
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	mux := runtime.NewServeMux()
+	require.NoError(t, pb.RegisterLaptopServiceHandler(context.Background(), mux, conn))
+	require.NoError(t, service.RegisterLaptopGatewayHandlers(mux, pb.NewLaptopServiceClient(conn)))
+	gateway := httptest.NewServer(mux)
+	defer gateway.Close()
+
+	// server streaming answers newline delimited JSON
+	res, err := http.Get(gateway.URL + "/v1/laptop/search?filter.max_price_usd=1000000")
+	require.NoError(t, err)
+	scanner := bufio.NewScanner(res.Body)
+	require.True(t, scanner.Scan())
+	var found struct {
+		Result struct {
+			Laptop struct{ ID string }
+		}
+	}
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &found))
+	require.Equal(t, laptop.GetId(), found.Result.Laptop.ID)
+	require.False(t, scanner.Scan())
+	res.Body.Close()
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	require.NoError(t, form.WriteField("laptop_id", laptop.GetId()))
+	image, err := form.CreateFormFile("image", "laptop.png")
+	require.NoError(t, err)
+	_, err = image.Write(bytes.Repeat([]byte{42}, 100000))
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+
+	res, err = http.Post(gateway.URL+service.UploadImageFormPath, form.FormDataContentType(), body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	uploaded := &pb.UploadImageResponse{}
+	require.NoError(t, (&runtime.JSONPb{}).NewDecoder(res.Body).Decode(uploaded))
+	res.Body.Close()
+	require.EqualValues(t, 100000, uploaded.GetSize())
+	require.FileExists(t, filepath.Join(imageFolder, uploaded.GetId()+".png"))
+
+	res, err = http.Post(gateway.URL+service.UploadImageFormPath, "text/plain", strings.NewReader("image"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	ratings := fmt.Sprintf(`{"ratings": [{"laptop_id": %q, "score": 8}, {"laptopId": %q, "score": 6}]}`, laptop.GetId(), laptop.GetId())
+	res, err = http.Post(gateway.URL+service.RateLaptopsPath, "application/json", strings.NewReader(ratings))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	rated := &pb.RateLaptopsResponse{}
+	require.NoError(t, (&runtime.JSONPb{}).NewDecoder(res.Body).Decode(rated))
+	res.Body.Close()
+	require.Len(t, rated.GetResults(), 2)
+	require.EqualValues(t, 2, rated.GetResults()[1].GetRatedCount())
+	require.Equal(t, 7.0, rated.GetResults()[1].GetAverageScore())
+
+	res, err = http.Post(gateway.URL+service.RateLaptopsPath, "application/json", strings.NewReader(`{"ratings": []}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	// the body is cut before it is decoded
+	rating := fmt.Sprintf(`{"laptop_id": %q, "score": 8}`, laptop.GetId())
+	huge := `{"ratings": [` + strings.Repeat(rating+",", 10000) + rating + `]}`
+	res, err = http.Post(gateway.URL+service.RateLaptopsPath, "application/json", strings.NewReader(huge))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	message, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(message), "too many ratings")
+	res.Body.Close()
+}
+
+func TestGatewayUploadImageFormType(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(filepath.Join(root, "img"))
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+
+	_, address, err := startTestLaptopServer(laptopStore, imageStore, nil)
+	require.NoError(t, err)
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	mux := runtime.NewServeMux()
+	require.NoError(t, service.RegisterLaptopGatewayHandlers(mux, pb.NewLaptopServiceClient(conn)))
+	gateway := httptest.NewServer(mux)
+	defer gateway.Close()
+
+	upload := func(imageType string, fileName string) int {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		require.NoError(t, form.WriteField("laptop_id", laptop.GetId()))
+		if len(imageType) > 0 {
+			require.NoError(t, form.WriteField("image_type", imageType))
+		}
+		image, err := form.CreateFormFile("image", fileName)
+		require.NoError(t, err)
+		_, err = image.Write([]byte("not an image"))
+		require.NoError(t, err)
+		require.NoError(t, form.Close())
+
+		res, err := http.Post(gateway.URL+service.UploadImageFormPath, form.FormDataContentType(), body)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	require.Equal(t, http.StatusBadRequest, upload("/../../escaped.txt", "laptop.png"))
+	require.Equal(t, http.StatusBadRequest, upload("/../../escaped.png", "laptop.png"))
+	require.Equal(t, http.StatusBadRequest, upload("", "../../escaped.txt"))
+	require.Equal(t, http.StatusBadRequest, upload("", "escaped"))
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("file %v written", path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+}
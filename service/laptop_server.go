@@ -5,7 +5,9 @@ import (
 	"context"
 	"errors"
 	"io"
-	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
 	"github.com/google/uuid"
@@ -38,7 +40,8 @@ func (s *LaptopServer) CreateLaptop(
 	req *pb.CreateLaptopRequest,
 ) (*pb.CreateLaptopResponse, error) {
 	laptop := req.GetLaptop()
-	log.Printf("receive createLaptop req with id: %v", laptop.Id)
+	logger := LoggerFromContext(ctx)
+	logger.Debug("create laptop", "laptop_id", laptop.GetId())
 
 	if len(laptop.Id) > 0 {
 		_, err := uuid.Parse(laptop.Id)
@@ -54,6 +57,13 @@ func (s *LaptopServer) CreateLaptop(
 		laptop.Id = id.String()
 	}
 
+	// the owner comes from the token, never from the request
+	laptop.Owner, laptop.Organization = "", ""
+	if claims := UserClaimsFromContext(ctx); claims != nil {
+		laptop.Owner = claims.Username
+		laptop.Organization = claims.Organization
+	}
+
 	err := contextError(ctx)
 	if err != nil {
 		return nil, err
@@ -69,7 +79,7 @@ func (s *LaptopServer) CreateLaptop(
 		return nil, status.Errorf(code, "cant save laptop obj: %v", err.Error())
 	}
 
-	log.Printf("saved laptop id: %v", laptop.Id)
+	logger.Info("laptop created", "laptop_id", laptop.Id)
 
 	return &pb.CreateLaptopResponse{
 		Id: laptop.Id,
@@ -79,7 +89,7 @@ func (s *LaptopServer) CreateLaptop(
 func (s *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest,
 	stream pb.LaptopService_SearchLaptopServer) error {
 	filter := req.GetFilter()
-	log.Printf("receiving")
+	logger := LoggerFromContext(stream.Context())
 
 	err := s.laptopStore.Search(stream.Context(),
 		filter,
@@ -91,7 +101,7 @@ func (s *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest,
 				return err
 			}
 
-			log.Printf("send laptop with id %v", laptop.GetId())
+			logger.Debug("laptop found", "laptop_id", laptop.GetId())
 
 			return nil
 		})
@@ -111,23 +121,23 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 
 	laptopID := req.GetInfo().GetLaptopId()
 	imageType := req.GetInfo().GetImageType()
-	log.Printf("receiver an image upload request from laptopID %s with type %s",
-		laptopID, imageType)
+	logger := LoggerFromContext(stream.Context())
+	logger.Debug("upload image", "laptop_id", laptopID, "image_type", imageType)
 
-	laptop, err := s.laptopStore.Find(context.TODO(), laptopID)
+	err = ValidateImageType(imageType)
 	if err != nil {
-		return status.Errorf(codes.Internal, "error when finding laptop %s", err.Error())
+		return status.Errorf(codes.InvalidArgument, "%v", err)
 	}
-	if laptop == nil {
-		return status.Errorf(codes.NotFound, "not found laptop %s", laptopID)
+
+	_, err = s.findOwnedLaptop(stream.Context(), laptopID)
+	if err != nil {
+		return err
 	}
 
 	imageData := bytes.NewBuffer(nil)
 	imageSize := 0
 
-	for log.Print("Start saving"); ; {
-		log.Print("receiving data chunk at chunk size ", imageSize)
-
+	for {
 		err := contextError(stream.Context())
 		if err != nil {
 			return err
@@ -135,7 +145,6 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 
 		req, err := stream.Recv()
 		if err == io.EOF {
-			log.Print("no more image data")
 			break
 		}
 		if err != nil {
@@ -148,6 +157,7 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 			return status.Errorf(codes.InvalidArgument, "too big image chunk")
 		}
 		imageSize += size
+		logger.Debug("image chunk received", "chunk_size", size, "image_size", imageSize)
 
 		_, err = imageData.Write(chunk)
 		if err != nil {
@@ -155,11 +165,13 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 		}
 	}
 
-	imageID, err := s.imageStore.Save(laptopID, imageType, *imageData)
+	imageID, err := s.imageStore.Save(stream.Context(), laptopID, imageType, *imageData)
 	if err != nil {
 		return status.Errorf(codes.Internal, "error when save file %v", err)
 	}
 
+	logger.Info("image saved", "laptop_id", laptopID, "image_id", imageID, "image_size", imageSize)
+
 	res := &pb.UploadImageResponse{
 		Id:   imageID,
 		Size: uint32(imageSize),
@@ -182,7 +194,6 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 
 		req, err := stream.Recv()
 		if err == io.EOF {
-			log.Print("rate laptop req has no more data")
 			break
 		}
 		if err != nil {
@@ -190,7 +201,7 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 		}
 
 		laptopID, score := req.LaptopId, req.Score
-		log.Printf("[Rating laptop] got laptop ID %v and score %v", laptopID, score)
+		LoggerFromContext(stream.Context()).Debug("rate laptop", "laptop_id", laptopID, "score", score)
 		found, err := s.laptopStore.Find(stream.Context(), laptopID)
 		if err != nil {
 			return status.Errorf(codes.Internal, "[Rating lapttop] error when find laptopID %v: %v", laptopID, err)
@@ -199,7 +210,7 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 			return status.Errorf(codes.NotFound, "[Rating lapttop] cant find laptop with id %v", laptopID)
 		}
 
-		rating, err := s.ratingStore.Add(laptopID, score)
+		rating, err := s.ratingStore.Add(stream.Context(), laptopID, score)
 		if err != nil {
 			return status.Errorf(codes.Internal, "[Rating lapttop] cant add rate to store %v: %v", laptopID, err)
 		}
@@ -219,14 +230,255 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 	return nil
 }
 
+func (s *LaptopServer) UpdateLaptop(
+	ctx context.Context,
+	req *pb.UpdateLaptopRequest,
+) (*pb.UpdateLaptopResponse, error) {
+	laptop := req.GetLaptop()
+	logger := LoggerFromContext(ctx)
+	logger.Debug("update laptop", "laptop_id", laptop.GetId())
+
+	_, err := uuid.Parse(laptop.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not uuid format: %v", err.Error())
+	}
+
+	err = contextError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.findOwnedLaptop(ctx, laptop.GetId())
+	if err != nil {
+		return nil, err
+	}
+	laptop.Owner = existing.GetOwner()
+	laptop.Organization = existing.GetOrganization()
+
+	err = s.laptopStore.Update(ctx, laptop)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotExist) {
+			code = codes.NotFound
+		}
+		return nil, status.Errorf(code, "cant update laptop obj: %v", err.Error())
+	}
+
+	logger.Info("laptop updated", "laptop_id", laptop.Id)
+
+	return &pb.UpdateLaptopResponse{
+		Id: laptop.Id,
+	}, nil
+}
+
+func (s *LaptopServer) DeleteLaptop(
+	ctx context.Context,
+	req *pb.DeleteLaptopRequest,
+) (*pb.DeleteLaptopResponse, error) {
+	laptopID := req.GetId()
+	logger := LoggerFromContext(ctx)
+	logger.Debug("delete laptop", "laptop_id", laptopID)
+
+	err := contextError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.findOwnedLaptop(ctx, laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.laptopStore.Delete(ctx, laptopID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotExist) {
+			code = codes.NotFound
+		}
+		return nil, status.Errorf(code, "cant delete laptop obj: %v", err.Error())
+	}
+
+	logger.Info("laptop deleted", "laptop_id", laptopID)
+
+	return &pb.DeleteLaptopResponse{
+		Id: laptopID,
+	}, nil
+}
+
+// resumeTokenInterval is how often a watch sends the resume token alone
+// while the filter drops every change.
+var resumeTokenInterval = 10 * time.Second
+
+// WatchLaptops sends the laptops matching the filter, then keeps sending
+// the laptops entering, changing inside or leaving the filter.
+func (s *LaptopServer) WatchLaptops(req *pb.WatchLaptopsRequest,
+	stream pb.LaptopService_WatchLaptopsServer) error {
+	filter := req.GetFilter()
+
+	since, err := parseResumeToken(req.GetResumeToken())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid resume token: %v", err)
+	}
+
+	watch, err := s.laptopStore.Watch(stream.Context(), since)
+	if err != nil {
+		if errors.Is(err, ErrRevisionCompacted) {
+			return status.Errorf(codes.OutOfRange, "resume token expired, watch again without it: %v", err)
+		}
+		return status.Errorf(codes.Internal, "cant watch laptops: %v", err)
+	}
+
+	var existing []*pb.Laptop
+	for _, laptop := range watch.Snapshot {
+		if isQualified(filter, laptop) {
+			existing = append(existing, laptop)
+		}
+	}
+
+	for i, laptop := range existing {
+		res := &pb.WatchLaptopsResponse{
+			Event:  pb.WatchLaptopsResponse_EXISTING,
+			Laptop: laptop,
+		}
+		// resuming in the middle of the snapshot would lose the rest of it
+		if i == len(existing)-1 {
+			res.ResumeToken = formatResumeToken(watch.Revision)
+		}
+		err := stream.Send(res)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the client needs a token to resume even when nothing matched
+	if since == 0 && len(existing) == 0 {
+		err := stream.Send(&pb.WatchLaptopsResponse{ResumeToken: formatResumeToken(watch.Revision)})
+		if err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(resumeTokenInterval)
+	defer ticker.Stop()
+
+	// skipped is the revision of the last event the filter dropped, it is
+	// sent alone on the next tick unless a matching event carries a newer one
+	var skipped uint64
+events:
+	for {
+		select {
+		case event, ok := <-watch.Events:
+			if !ok {
+				break events
+			}
+
+			kind, laptop := filterEvent(filter, event)
+			if kind == pb.WatchLaptopsResponse_UNKNOWN {
+				skipped = event.Revision
+				continue
+			}
+
+			err := stream.Send(&pb.WatchLaptopsResponse{
+				Event:       kind,
+				Laptop:      laptop,
+				ResumeToken: formatResumeToken(event.Revision),
+			})
+			if err != nil {
+				return err
+			}
+			skipped = 0
+			LoggerFromContext(stream.Context()).Debug("laptop event sent", "event", kind.String(), "laptop_id", laptop.GetId())
+		case <-ticker.C:
+			if skipped == 0 {
+				continue
+			}
+
+			err := stream.Send(&pb.WatchLaptopsResponse{ResumeToken: formatResumeToken(skipped)})
+			if err != nil {
+				return err
+			}
+			skipped = 0
+		}
+	}
+
+	err = contextError(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	return status.Errorf(codes.Aborted, "watch fell behind, resume with the last token")
+}
+
+// findOwnedLaptop returns the laptop if the caller may modify it.
+func (s *LaptopServer) findOwnedLaptop(ctx context.Context, id string) (*pb.Laptop, error) {
+	laptop, err := s.laptopStore.Find(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			return nil, status.Errorf(codes.NotFound, "not found laptop %s", id)
+		}
+		return nil, status.Errorf(codes.Internal, "error when finding laptop %s", err.Error())
+	}
+
+	if !CanModifyLaptop(UserClaimsFromContext(ctx), laptop) {
+		return nil, status.Errorf(codes.PermissionDenied, "laptop %s belongs to another user", id)
+	}
+
+	return laptop, nil
+}
+
+// CanModifyLaptop tells if the caller is a super admin, the owner of the
+// laptop or a member of its organization.
+func CanModifyLaptop(claims *UserClaims, laptop *pb.Laptop) bool {
+	if claims == nil {
+		return false
+	}
+	if strings.EqualFold(claims.Role, SuperAdminRole) {
+		return true
+	}
+	if len(laptop.GetOwner()) > 0 && claims.Username == laptop.GetOwner() {
+		return true
+	}
+	return len(laptop.GetOrganization()) > 0 && claims.Organization == laptop.GetOrganization()
+}
+
+// filterEvent tells how a store event looks through the filter: a laptop
+// updated into the filter is created for the watcher, one updated out of it
+// is deleted.
+func filterEvent(filter *pb.Filter, event *LaptopEvent) (pb.WatchLaptopsResponse_Event, *pb.Laptop) {
+	before := event.Old != nil && isQualified(filter, event.Old)
+	after := event.New != nil && isQualified(filter, event.New)
+
+	switch {
+	case !before && after:
+		return pb.WatchLaptopsResponse_CREATED, event.New
+	case before && after:
+		return pb.WatchLaptopsResponse_UPDATED, event.New
+	case before && !after:
+		return pb.WatchLaptopsResponse_DELETED, event.Old
+	default:
+		return pb.WatchLaptopsResponse_UNKNOWN, nil
+	}
+}
+
+func parseResumeToken(token string) (uint64, error) {
+	if len(token) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(token, 10, 64)
+}
+
+func formatResumeToken(revision uint64) string {
+	return strconv.FormatUint(revision, 10)
+}
+
 func contextError(ctx context.Context) error {
 	if ctx.Err() == context.DeadlineExceeded {
-		log.Print("deadline exceed")
+		LoggerFromContext(ctx).Debug("deadline exceeded")
 		return status.Error(codes.DeadlineExceeded, "deadline exceed with laptop")
 	}
 
 	if ctx.Err() == context.Canceled {
-		log.Print("request cancel by client")
+		LoggerFromContext(ctx).Debug("request canceled by the client")
 		return status.Error(codes.Canceled, "request cancel by client")
 	}
 
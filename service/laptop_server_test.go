@@ -84,3 +84,111 @@ func TestServerSaveLaptop(t *testing.T) {
 		})
 	}
 }
+
+func TestServerLaptopOwnership(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	server := service.NewLaptopServer(store, nil, nil)
+
+	asUser := func(username, role, organization string) context.Context {
+		return service.ContextWithUserClaims(context.Background(), &service.UserClaims{
+			Username:     username,
+			Role:         role,
+			Organization: organization,
+		})
+	}
+	owner := asUser("alice", "admin", "acme")
+	colleague := asUser("bob", "admin", "acme")
+	stranger := asUser("eve", "admin", "other")
+	superAdmin := asUser("root", service.SuperAdminRole, "")
+
+	laptop := sample.NewLaptop()
+	laptop.Owner = "eve"
+	_, err := server.CreateLaptop(owner, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	saved, err := store.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, "alice", saved.GetOwner())
+	require.Equal(t, "acme", saved.GetOrganization())
+
+	update := sample.NewLaptop()
+	update.Id = laptop.Id
+	_, err = server.UpdateLaptop(stranger, &pb.UpdateLaptopRequest{Laptop: update})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DeleteLaptop(stranger, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the owner cant be changed by an update
+	update.Owner, update.Organization = "bob", "other"
+	_, err = server.UpdateLaptop(colleague, &pb.UpdateLaptopRequest{Laptop: update})
+	require.NoError(t, err)
+
+	saved, err = store.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, "alice", saved.GetOwner())
+	require.Equal(t, "acme", saved.GetOrganization())
+
+	_, err = server.DeleteLaptop(superAdmin, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+}
+
+func TestServerTenantIsolation(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	server := service.NewLaptopServer(store, nil, service.NewInMemoryRatingStore())
+
+	asTenant := func(tenant string) context.Context {
+		return service.ContextWithUserClaims(context.Background(), &service.UserClaims{
+			Username: "admin-" + tenant,
+			Role:     service.SuperAdminRole,
+			Tenant:   tenant,
+		})
+	}
+	acme, globex := asTenant("acme"), asTenant("globex")
+
+	laptop := sample.NewLaptop()
+	_, err := server.CreateLaptop(acme, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	// the same id is another laptop in another tenant
+	other := sample.NewLaptop()
+	other.Id = laptop.Id
+	_, err = server.CreateLaptop(globex, &pb.CreateLaptopRequest{Laptop: other})
+	require.NoError(t, err)
+
+	search := func(ctx context.Context) []*pb.Laptop {
+		var found []*pb.Laptop
+		err := store.Search(ctx, &pb.Filter{MaxPriceUsd: 1e9}, func(laptop *pb.Laptop) error {
+			found = append(found, laptop)
+			return nil
+		})
+		require.NoError(t, err)
+		return found
+	}
+	require.Len(t, search(acme), 1)
+	require.Same(t, laptop, search(acme)[0])
+	require.Len(t, search(globex), 1)
+	require.Same(t, other, search(globex)[0])
+	require.Empty(t, search(context.Background()))
+
+	_, err = server.DeleteLaptop(globex, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+	_, err = store.Find(acme, laptop.Id)
+	require.NoError(t, err)
+	_, err = server.DeleteLaptop(globex, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	watch, err := store.Watch(acme, 0)
+	require.NoError(t, err)
+	require.Len(t, watch.Snapshot, 1)
+	require.NoError(t, store.Save(globex, sample.NewLaptop()))
+	require.NoError(t, store.Delete(acme, laptop.Id))
+	event := <-watch.Events
+	require.Equal(t, "acme", event.Tenant)
+	require.Equal(t, laptop.Id, event.Old.GetId())
+}
@@ -3,39 +3,56 @@ package service
 import (
 	"context"
 	"errors"
-	"log"
 	"sync"
 
 	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
 )
 
 var (
-	ErrAlreadyExist = errors.New("already exist")
-	ErrNotExist     = errors.New("not exist")
+	ErrAlreadyExist      = errors.New("already exist")
+	ErrNotExist          = errors.New("not exist")
+	ErrRevisionCompacted = errors.New("revision compacted")
 )
 
+// LaptopStore keeps a catalog per tenant, every operation is scoped by the
+// tenant of the caller, see TenantFromContext.
 type LaptopStore interface {
 	Save(context.Context, *pb.Laptop) error
+	Update(context.Context, *pb.Laptop) error
+	Delete(context.Context, string) error
 	Find(context.Context, string) (*pb.Laptop, error)
 	Search(context.Context, *pb.Filter, func(laptop *pb.Laptop) error) error
+	// Watch returns the laptops stored now, unless since is given, and
+	// every change made after them until ctx is done. Revisions are shared
+	// by all the tenants.
+	Watch(ctx context.Context, since uint64) (*LaptopWatch, error)
 }
 
 type InMemoryLaptopStore struct {
-	data  map[string]*pb.Laptop
-	mutex sync.RWMutex
+	// data maps a tenant to its laptops by id
+	data     map[string]map[string]*pb.Laptop
+	mutex    sync.RWMutex
+	revision uint64
+	history  []*LaptopEvent
+	watchers map[*laptopWatcher]struct{}
 }
 
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
 	return &InMemoryLaptopStore{
-		data: make(map[string]*pb.Laptop),
+		data:     make(map[string]map[string]*pb.Laptop),
+		watchers: make(map[*laptopWatcher]struct{}),
+		// revision 0 is left to mean "not resuming" in Watch
+		revision: 1,
 	}
 }
 
 func (i *InMemoryLaptopStore) Save(ctx context.Context, laptop *pb.Laptop) error {
+	tenant := TenantFromContext(ctx)
+
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
-	if _, exist := i.data[laptop.Id]; exist {
+	if _, exist := i.data[tenant][laptop.Id]; exist {
 		return ErrAlreadyExist
 	}
 
@@ -43,17 +60,80 @@ func (i *InMemoryLaptopStore) Save(ctx context.Context, laptop *pb.Laptop) error
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
-		i.data[laptop.Id] = laptop
+		if i.data[tenant] == nil {
+			i.data[tenant] = make(map[string]*pb.Laptop)
+		}
+		i.data[tenant][laptop.Id] = laptop
+	}
+
+	i.publish(tenant, nil, laptop)
+	return nil
+}
+
+func (i *InMemoryLaptopStore) Update(ctx context.Context, laptop *pb.Laptop) error {
+	tenant := TenantFromContext(ctx)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	old, exist := i.data[tenant][laptop.Id]
+	if !exist {
+		return ErrNotExist
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		i.data[tenant][laptop.Id] = laptop
 	}
 
+	i.publish(tenant, old, laptop)
 	return nil
 }
 
+func (i *InMemoryLaptopStore) Delete(ctx context.Context, id string) error {
+	tenant := TenantFromContext(ctx)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	old, exist := i.data[tenant][id]
+	if !exist {
+		return ErrNotExist
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		delete(i.data[tenant], id)
+	}
+
+	i.publish(tenant, old, nil)
+	return nil
+}
+
+// Count returns the number of laptops of every tenant.
+func (i *InMemoryLaptopStore) Count() int {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	count := 0
+	for _, laptops := range i.data {
+		count += len(laptops)
+	}
+	return count
+}
+
 func (i *InMemoryLaptopStore) Find(ctx context.Context, id string) (*pb.Laptop, error) {
+	tenant := TenantFromContext(ctx)
+
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
 
-	if _, exist := i.data[id]; !exist {
+	laptop, exist := i.data[tenant][id]
+	if !exist {
 		return nil, ErrNotExist
 	}
 
@@ -61,22 +141,18 @@ func (i *InMemoryLaptopStore) Find(ctx context.Context, id string) (*pb.Laptop,
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
-		return i.data[id], nil
+		return laptop, nil
 	}
 }
 
 func (i *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter,
 	found func(laptop *pb.Laptop) error) error {
+	tenant := TenantFromContext(ctx)
+
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
 
-	for _, laptop := range i.data {
-
-		log.Print("checking laptop id", laptop.Id)
-		if ctx.Err() != nil {
-			log.Printf("context cancel with err %v", ctx.Err())
-		}
-
+	for _, laptop := range i.data[tenant] {
 		if isQualified(filter, laptop) {
 			err := found(laptop)
 			if err != nil {
@@ -101,7 +177,7 @@ func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
 		return false
 	}
 
-	if toBit(laptop.GetRam()) < toBit(filter.MinRam) {
+	if toBit(laptop.GetRam()) < toBit(filter.GetMinRam()) {
 		return false
 	}
 
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+)
+
+// maxWatchHistory is how many past events a watch can be resumed from.
+// It is also the buffer of every watcher, so a resumed watch always fits.
+const maxWatchHistory = 1024
+
+// LaptopEvent is one change in a LaptopStore. Old is nil for a created
+// laptop and New is nil for a deleted one.
+type LaptopEvent struct {
+	Revision uint64
+	Tenant   string
+	Old      *pb.Laptop
+	New      *pb.Laptop
+}
+
+type LaptopWatch struct {
+	// Snapshot is empty when the watch is resumed.
+	Snapshot []*pb.Laptop
+	// Revision is the store revision Snapshot was taken at.
+	Revision uint64
+	// Events is closed when the watch context is done, or when the
+	// watcher fell too far behind and has to resume from its last event.
+	Events <-chan *LaptopEvent
+}
+
+type laptopWatcher struct {
+	tenant string
+	events chan *LaptopEvent
+}
+
+func (i *InMemoryLaptopStore) Watch(ctx context.Context, since uint64) (*LaptopWatch, error) {
+	tenant := TenantFromContext(ctx)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	watcher := &laptopWatcher{tenant: tenant, events: make(chan *LaptopEvent, maxWatchHistory)}
+	watch := &LaptopWatch{Revision: i.revision, Events: watcher.events}
+
+	if since == 0 {
+		for _, laptop := range i.data[tenant] {
+			watch.Snapshot = append(watch.Snapshot, laptop)
+		}
+	} else {
+		if since > i.revision {
+			return nil, ErrRevisionCompacted
+		}
+		if len(i.history) > 0 && since < i.history[0].Revision-1 {
+			return nil, ErrRevisionCompacted
+		}
+		for _, event := range i.history {
+			if event.Revision > since && event.Tenant == tenant {
+				watcher.events <- event
+			}
+		}
+	}
+
+	i.watchers[watcher] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+		i.removeWatcher(watcher)
+	}()
+
+	return watch, nil
+}
+
+// publish records a change and fans it out to the watchers of the tenant.
+// The caller must hold the write lock.
+func (i *InMemoryLaptopStore) publish(tenant string, old, new *pb.Laptop) {
+	i.revision++
+	event := &LaptopEvent{Revision: i.revision, Tenant: tenant, Old: old, New: new}
+
+	i.history = append(i.history, event)
+	if len(i.history) > maxWatchHistory {
+		i.history = i.history[len(i.history)-maxWatchHistory:]
+	}
+
+	for watcher := range i.watchers {
+		if watcher.tenant != tenant {
+			continue
+		}
+		select {
+		case watcher.events <- event:
+		default:
+			// slow watcher, drop it rather than block the writers
+			i.removeWatcher(watcher)
+		}
+	}
+}
+
+func (i *InMemoryLaptopStore) removeWatcher(watcher *laptopWatcher) {
+	if _, ok := i.watchers[watcher]; ok {
+		delete(i.watchers, watcher)
+		close(watcher.events)
+	}
+}
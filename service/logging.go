@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDKey is the gRPC metadata key, and the HTTP header, carrying the
+// request ID.
+const RequestIDKey = "x-request-id"
+
+const maxRequestIDLength = 128
+
+// redactedKeys are the log attributes never written in clear.
+var redactedKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"authorization": true,
+	"api_key":       true,
+	"client_secret": true,
+}
+
+// NewLogger writes text or json lines from level up, hiding the tokens and
+// passwords.
+func NewLogger(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: RedactAttr}
+	switch format {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expect text or json", format)
+	}
+}
+
+// RedactAttr replaces the value of the secret attributes, it is meant for
+// slog.HandlerOptions.ReplaceAttr.
+func RedactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "REDACTED")
+	}
+	return attr
+}
+
+type loggerKey struct{}
+
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the logger of the call, which adds its request
+// ID to every line, or the default logger outside of a call.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// RequestID returns id if a caller may pass it on, and a new ID otherwise.
+func RequestID(id string) string {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return uuid.NewString()
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return uuid.NewString()
+		}
+	}
+	return id
+}
+
+// LoggingInterceptor gives every call a request ID, taken from the
+// x-request-id metadata or generated, and returned in the trailers. The
+// handlers log through LoggerFromContext, and a line is written once the
+// call is done.
+type LoggingInterceptor struct {
+	logger *slog.Logger
+}
+
+func NewLoggingInterceptor(logger *slog.Logger) *LoggingInterceptor {
+	return &LoggingInterceptor{logger: logger}
+}
+
+func (i *LoggingInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		id := incomingRequestID(ctx)
+		err := grpc.SetTrailer(ctx, metadata.Pairs(RequestIDKey, id))
+		if err != nil {
+			i.logger.Warn("cant set request ID trailer", "error", err)
+		}
+
+		logger := i.callLogger(ctx, id, info.FullMethod)
+		start := time.Now()
+		resp, err := handler(ContextWithLogger(ctx, logger), req)
+		logCall(logger, start, err)
+		return resp, err
+	}
+}
+
+func (i *LoggingInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(server interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		id := incomingRequestID(stream.Context())
+		stream.SetTrailer(metadata.Pairs(RequestIDKey, id))
+
+		logger := i.callLogger(stream.Context(), id, info.FullMethod)
+		start := time.Now()
+		err := handler(server, &serverStreamWithContext{
+			ServerStream: stream,
+			ctx:          ContextWithLogger(stream.Context(), logger),
+		})
+		logCall(logger, start, err)
+		return err
+	}
+}
+
+func (i *LoggingInterceptor) callLogger(ctx context.Context, id string, method string) *slog.Logger {
+	logger := i.logger.With("request_id", id, "method", method)
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		logger = logger.With("trace_id", span.TraceID().String())
+	}
+	return logger
+}
+
+func incomingRequestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ids := md.Get(RequestIDKey)
+	if len(ids) == 0 {
+		return RequestID("")
+	}
+	return RequestID(ids[0])
+}
+
+// logCall writes the outcome of a call, as an error when the server is at
+// fault.
+func logCall(logger *slog.Logger, start time.Time, err error) {
+	st := status.Convert(err)
+	level := slog.LevelInfo
+	switch st.Code() {
+	case codes.Unknown, codes.Internal, codes.DataLoss, codes.Unimplemented, codes.Unavailable:
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{
+		slog.String("code", st.Code().String()),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", st.Message()))
+	}
+	logger.LogAttrs(context.Background(), level, "call done", attrs...)
+}
@@ -0,0 +1,94 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoggingInterceptor(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+	logger, err := service.NewLogger(&output, slog.LevelDebug, "json")
+	require.NoError(t, err)
+	interceptor := service.NewLoggingInterceptor(logger)
+
+	call := func(requestID string) (trailer metadata.MD, lines []map[string]interface{}) {
+		output.Reset()
+		ctx := context.Background()
+		if len(requestID) > 0 {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(service.RequestIDKey, requestID))
+		}
+		transport := &trailerTransportStream{}
+		ctx = grpc.NewContextWithServerTransportStream(ctx, transport)
+
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.AuthService/Login"}
+		_, err := interceptor.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			service.LoggerFromContext(ctx).Info("login", "username", "user1", "password", "secret1", "access_token", "abc")
+			return nil, status.Errorf(codes.Unauthenticated, "wrong password")
+		})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+			fields := make(map[string]interface{})
+			require.NoError(t, json.Unmarshal([]byte(line), &fields))
+			lines = append(lines, fields)
+		}
+		return transport.trailer, lines
+	}
+
+	trailer, lines := call("req-42")
+	require.Equal(t, []string{"req-42"}, trailer.Get(service.RequestIDKey))
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		require.Equal(t, "req-42", line["request_id"])
+		require.Equal(t, "/pb.AuthService/Login", line["method"])
+	}
+	require.Equal(t, "user1", lines[0]["username"])
+	require.Equal(t, "REDACTED", lines[0]["password"])
+	require.Equal(t, "REDACTED", lines[0]["access_token"])
+	require.Equal(t, "call done", lines[1]["msg"])
+	require.Equal(t, "Unauthenticated", lines[1]["code"])
+
+	// a missing or unsafe ID is replaced
+	for _, requestID := range []string{"", "bad id\nwith a line break"} {
+		trailer, lines = call(requestID)
+		generated := trailer.Get(service.RequestIDKey)
+		require.Len(t, generated, 1)
+		require.NotEqual(t, requestID, generated[0])
+		require.Equal(t, generated[0], lines[0]["request_id"])
+	}
+}
+
+// trailerTransportStream keeps the trailer set by a unary handler.
+type trailerTransportStream struct {
+	trailer metadata.MD
+}
+
+func (s *trailerTransportStream) Method() string {
+	return ""
+}
+
+func (s *trailerTransportStream) SetHeader(md metadata.MD) error {
+	return nil
+}
+
+func (s *trailerTransportStream) SendHeader(md metadata.MD) error {
+	return nil
+}
+
+func (s *trailerTransportStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// LoginLimits slow down password guessing. Failures are counted per
+// username and per peer IP, and forgotten after LockoutDuration without
+// a new one.
+type LoginLimits struct {
+	// FreeFailures for a username, PeerFreeFailures for an IP, are allowed
+	// before any delay.
+	FreeFailures     int
+	PeerFreeFailures int
+	// BaseDelay doubles with every failure after the free ones, up to
+	// MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutFailures for a username, or PeerLockoutFailures for an IP
+	// shared by many users, lock it out for LockoutDuration.
+	LockoutFailures     int
+	PeerLockoutFailures int
+	LockoutDuration     time.Duration
+}
+
+var DefaultLoginLimits = LoginLimits{
+	FreeFailures:        3,
+	PeerFreeFailures:    20,
+	BaseDelay:           time.Second,
+	MaxDelay:            time.Minute,
+	LockoutFailures:     10,
+	PeerLockoutFailures: 100,
+	LockoutDuration:     15 * time.Minute,
+}
+
+// loginLimiterSweepInterval is how often the forgotten failures are
+// dropped, a stale entry is reset when used in between.
+const loginLimiterSweepInterval = time.Minute
+
+type LoginLimiter struct {
+	limits    LoginLimits
+	mutex     sync.Mutex
+	failures  map[string]*loginFailures
+	lastSweep time.Time
+}
+
+type loginFailures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func NewLoginLimiter(limits LoginLimits) *LoginLimiter {
+	return &LoginLimiter{
+		limits:    limits,
+		failures:  make(map[string]*loginFailures),
+		lastSweep: time.Now(),
+	}
+}
+
+// Attempt returns how long the username or the peer IP must wait before
+// trying again. When they may try now, the attempt is counted as a failure
+// right away, so parallel guesses cant all pass before the first one
+// fails, and Succeed takes it back. Unknown usernames are counted too, so
+// the limits dont tell which accounts exist.
+func (l *LoginLimiter) Attempt(username, peerIP string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	keys := loginKeys(username, peerIP)
+	var wait time.Duration
+	for _, key := range keys {
+		failures := l.entry(key, now)
+		if failures != nil && failures.blockedUntil.Sub(now) > wait {
+			wait = failures.blockedUntil.Sub(now)
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for i, key := range keys {
+		freeFailures, lockoutFailures := l.limits.FreeFailures, l.limits.LockoutFailures
+		if i > 0 {
+			freeFailures, lockoutFailures = l.limits.PeerFreeFailures, l.limits.PeerLockoutFailures
+		}
+
+		failures := l.entry(key, now)
+		if failures == nil {
+			failures = &loginFailures{}
+			l.failures[key] = failures
+		}
+		failures.count++
+		failures.last = now
+
+		switch {
+		case failures.count >= lockoutFailures:
+			failures.blockedUntil = now.Add(l.limits.LockoutDuration)
+		case failures.count > freeFailures:
+			failures.blockedUntil = now.Add(l.delay(failures.count - freeFailures))
+		}
+	}
+	return 0
+}
+
+// Succeed forgets the failures of the username after a successful login.
+// The peer IP only gets its attempt back, a valid account must not let an
+// attacker guess the others.
+func (l *LoginLimiter) Succeed(username, peerIP string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	keys := loginKeys(username, peerIP)
+	delete(l.failures, keys[0])
+	if len(keys) == 1 {
+		return
+	}
+
+	failures := l.failures[keys[1]]
+	if failures == nil {
+		return
+	}
+	failures.count--
+	if failures.count <= l.limits.PeerFreeFailures {
+		failures.blockedUntil = time.Time{}
+	}
+	if failures.count <= 0 {
+		delete(l.failures, keys[1])
+	}
+}
+
+// Unlock forgets the failures of the username, when an admin unlocks the
+// account.
+func (l *LoginLimiter) Unlock(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.failures, loginKeys(username, "")[0])
+}
+
+// entry returns the failures of key, nil if there are none or they are
+// forgotten.
+func (l *LoginLimiter) entry(key string, now time.Time) *loginFailures {
+	failures := l.failures[key]
+	if failures != nil && l.forgotten(failures, now) {
+		delete(l.failures, key)
+		return nil
+	}
+	return failures
+}
+
+func (l *LoginLimiter) forgotten(failures *loginFailures, now time.Time) bool {
+	return now.Sub(failures.last) > l.limits.LockoutDuration && now.After(failures.blockedUntil)
+}
+
+// sweep drops the forgotten failures, at most once per interval so that
+// the failed logins dont slow down the others.
+func (l *LoginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < loginLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, failures := range l.failures {
+		if l.forgotten(failures, now) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+func (l *LoginLimiter) delay(extraFailures int) time.Duration {
+	delay := l.limits.BaseDelay
+	for i := 1; i < extraFailures && delay < l.limits.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.limits.MaxDelay {
+		delay = l.limits.MaxDelay
+	}
+	return delay
+}
+
+func loginKeys(username, peerIP string) []string {
+	keys := []string{"user:" + username}
+	if len(peerIP) > 0 {
+		keys = append(keys, "peer:"+peerIP)
+	}
+	return keys
+}
+
+// peerIP returns the IP the call comes from, empty when unknown.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsInterceptor counts the calls and measures their latency per method
+// and status code. It must run before the other interceptors so that the
+// calls they reject are counted too.
+type MetricsInterceptor struct {
+	requests    *prometheus.CounterVec
+	durations   *prometheus.HistogramVec
+	streams     *prometheus.GaugeVec
+	uploadBytes prometheus.Counter
+}
+
+// NewMetricsInterceptor registers the call metrics with registerer. A single
+// interceptor serves every gRPC server of the process.
+func NewMetricsInterceptor(registerer prometheus.Registerer) (*MetricsInterceptor, error) {
+	interceptor := &MetricsInterceptor{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pcbook_grpc_requests_total",
+			Help: "Calls handled, by method and status code.",
+		}, []string{"method", "code"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pcbook_grpc_request_duration_seconds",
+			Help:    "Time to handle a call, the whole stream for streaming calls.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"method", "code"}),
+		streams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pcbook_grpc_active_streams",
+			Help: "Streaming calls being served, by method.",
+		}, []string{"method"}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pcbook_image_upload_bytes_total",
+			Help: "Image bytes received by UploadImage, failed uploads included.",
+		}),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		interceptor.requests,
+		interceptor.durations,
+		interceptor.streams,
+		interceptor.uploadBytes,
+	} {
+		err := registerer.Register(collector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return interceptor, nil
+}
+
+func (i *MetricsInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		i.observe(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+func (i *MetricsInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(server interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		active := i.streams.WithLabelValues(info.FullMethod)
+		active.Inc()
+		defer active.Dec()
+
+		start := time.Now()
+		err := handler(server, &metricsServerStream{ServerStream: stream, uploadBytes: i.uploadBytes})
+		i.observe(info.FullMethod, start, err)
+		return err
+	}
+}
+
+func (i *MetricsInterceptor) observe(method string, start time.Time, err error) {
+	code := status.Code(err).String()
+	i.requests.WithLabelValues(method, code).Inc()
+	i.durations.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
+
+type metricsServerStream struct {
+	grpc.ServerStream
+	uploadBytes prometheus.Counter
+}
+
+func (s *metricsServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if req, ok := m.(*pb.UploadImageRequest); ok && err == nil {
+		s.uploadBytes.Add(float64(len(req.GetChunkData())))
+	}
+	return err
+}
+
+// NewStoreMetrics returns gauges reading the size of the stores when
+// scraped.
+func NewStoreMetrics(laptopStore *InMemoryLaptopStore,
+	imageStore *DiskImageStore,
+	ratingStore *InMemoryRatingStore) []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "pcbook_laptops",
+			Help: "Laptops stored, every tenant included.",
+		}, func() float64 {
+			return float64(laptopStore.Count())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "pcbook_image_bytes",
+			Help: "Size on disk of the images saved since the server started.",
+		}, func() float64 {
+			return float64(imageStore.Bytes())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "pcbook_ratings",
+			Help: "Ratings given, every tenant included.",
+		}, func() float64 {
+			return float64(ratingStore.Count())
+		}),
+	}
+}
@@ -0,0 +1,126 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/sample"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsInterceptor(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	metrics, err := service.NewMetricsInterceptor(registry)
+	require.NoError(t, err)
+
+	unary := func(err error) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.LaptopService/CreateLaptop"}
+		_, _ = metrics.Unary()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, err
+		})
+	}
+	unary(nil)
+	unary(nil)
+	unary(status.Errorf(codes.NotFound, "cant find laptop"))
+
+	info := &grpc.StreamServerInfo{FullMethod: "/pb.LaptopService/UploadImage"}
+	stream := &uploadServerStream{chunks: [][]byte{make([]byte, 100), make([]byte, 28)}}
+	err = metrics.Stream()(nil, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+		require.Equal(t, 1, testutil.CollectAndCount(registry, "pcbook_grpc_active_streams"))
+		for {
+			err := stream.RecvMsg(&pb.UploadImageRequest{})
+			if err != nil {
+				return nil
+			}
+		}
+	})
+	require.NoError(t, err)
+
+	expected := `
+# HELP pcbook_grpc_requests_total Calls handled, by method and status code.
+# TYPE pcbook_grpc_requests_total counter
+pcbook_grpc_requests_total{code="NotFound",method="/pb.LaptopService/CreateLaptop"} 1
+pcbook_grpc_requests_total{code="OK",method="/pb.LaptopService/CreateLaptop"} 2
+pcbook_grpc_requests_total{code="OK",method="/pb.LaptopService/UploadImage"} 1
+# HELP pcbook_grpc_active_streams Streaming calls being served, by method.
+# TYPE pcbook_grpc_active_streams gauge
+pcbook_grpc_active_streams{method="/pb.LaptopService/UploadImage"} 0
+# HELP pcbook_image_upload_bytes_total Image bytes received by UploadImage, failed uploads included.
+# TYPE pcbook_image_upload_bytes_total counter
+pcbook_image_upload_bytes_total 128
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"pcbook_grpc_requests_total", "pcbook_grpc_active_streams", "pcbook_image_upload_bytes_total")
+	require.NoError(t, err)
+	require.Equal(t, 3, testutil.CollectAndCount(registry, "pcbook_grpc_request_duration_seconds"))
+}
+
+func TestStoreMetrics(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	imageStore := service.NewDiskImageStore(t.TempDir())
+
+	ctx := context.Background()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(ctx, laptop))
+	require.NoError(t, laptopStore.Save(service.ContextWithUserClaims(ctx, &service.UserClaims{Tenant: "acme"}), sample.NewLaptop()))
+	_, err := ratingStore.Add(ctx, laptop.Id, 8)
+	require.NoError(t, err)
+	_, err = ratingStore.Add(ctx, laptop.Id, 6)
+	require.NoError(t, err)
+	_, err = imageStore.Save(ctx, laptop.Id, ".jpg", *bytes.NewBuffer(make([]byte, 100)))
+	require.NoError(t, err)
+	_, err = imageStore.Save(ctx, laptop.Id, ".png", *bytes.NewBuffer(make([]byte, 28)))
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	for _, collector := range service.NewStoreMetrics(laptopStore, imageStore, ratingStore) {
+		require.NoError(t, registry.Register(collector))
+	}
+
+	expected := `
+# HELP pcbook_image_bytes Size on disk of the images saved since the server started.
+# TYPE pcbook_image_bytes gauge
+pcbook_image_bytes 128
+# HELP pcbook_laptops Laptops stored, every tenant included.
+# TYPE pcbook_laptops gauge
+pcbook_laptops 2
+# HELP pcbook_ratings Ratings given, every tenant included.
+# TYPE pcbook_ratings gauge
+pcbook_ratings 2
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected), "pcbook_image_bytes", "pcbook_laptops", "pcbook_ratings")
+	require.NoError(t, err)
+}
+
+// uploadServerStream receives the chunks of an image.
+type uploadServerStream struct {
+	grpc.ServerStream
+	chunks [][]byte
+}
+
+func (s *uploadServerStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *uploadServerStream) RecvMsg(m interface{}) error {
+	if len(s.chunks) == 0 {
+		return status.Errorf(codes.Canceled, "no more chunks")
+	}
+	m.(*pb.UploadImageRequest).Data = &pb.UploadImageRequest_ChunkData{ChunkData: s.chunks[0]}
+	s.chunks = s.chunks[1:]
+	return nil
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTimeout is how long the user has to sign in at the provider.
+const oidcLoginTimeout = 10 * time.Minute
+
+// MaxPendingOIDCLogins caps the logins waiting for the provider, as
+// anybody may start one. The oldest are dropped first.
+const MaxPendingOIDCLogins = 10000
+
+var (
+	ErrOIDCState  = errors.New("unknown or expired OIDC login state")
+	ErrOIDCNoRole = errors.New("no pcbook role for the OIDC user")
+)
+
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the FinishOIDCLogin route the provider sends the
+	// browser back to.
+	RedirectURL string
+	// UsernameClaim names the pcbook account, "preferred_username" if empty.
+	UsernameClaim string
+	// GroupsClaim lists the groups of the user, "groups" if empty. It may
+	// be a single string.
+	GroupsClaim string
+	// Roles maps groups to pcbook roles, the first group the user is in
+	// wins.
+	Roles []OIDCRole
+	// DefaultRole is given to the users in none of the groups, they are
+	// rejected if it is empty.
+	DefaultRole string
+}
+
+type OIDCRole struct {
+	Group string
+	Role  string
+}
+
+// OIDCIdentity is a user signed in by the identity provider.
+type OIDCIdentity struct {
+	// ExternalID is the issuer and subject, stable across renames.
+	ExternalID string
+	Username   string
+	Role       string
+}
+
+// OIDCProvider runs the authorization code flow, with PKCE and a nonce,
+// against an OpenID Connect provider found by discovery.
+type OIDCProvider struct {
+	config   OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	mutex   sync.Mutex
+	pending map[string]*pendingOIDCLogin
+	// order lists the pending states oldest first.
+	order *list.List
+}
+
+type pendingOIDCLogin struct {
+	nonce        string
+	codeVerifier string
+	expiresAt    time.Time
+	element      *list.Element
+}
+
+// NewOIDCProvider reads the provider configuration from its discovery
+// document. ctx may carry an HTTP client, see oidc.ClientContext.
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("cant discover OIDC provider %v: %w", config.IssuerURL, err)
+	}
+
+	if len(config.UsernameClaim) == 0 {
+		config.UsernameClaim = "preferred_username"
+	}
+	if len(config.GroupsClaim) == 0 {
+		config.GroupsClaim = "groups"
+	}
+
+	return &OIDCProvider{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		pending:  make(map[string]*pendingOIDCLogin),
+		order:    list.New(),
+	}, nil
+}
+
+// AuthCodeURL starts a login and returns where to send the browser.
+func (p *OIDCProvider) AuthCodeURL() (authURL string, state string, err error) {
+	state, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	login := &pendingOIDCLogin{expiresAt: time.Now().Add(oidcLoginTimeout)}
+	login.nonce, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	login.codeVerifier, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	p.mutex.Lock()
+	now := time.Now()
+	for oldest := p.order.Front(); oldest != nil; oldest = p.order.Front() {
+		if len(p.pending) < MaxPendingOIDCLogins && now.Before(p.pending[oldest.Value.(string)].expiresAt) {
+			break
+		}
+		p.removePending(oldest.Value.(string))
+	}
+	login.element = p.order.PushBack(state)
+	p.pending[state] = login
+	p.mutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.codeVerifier))
+	authURL = p.oauth2.AuthCodeURL(state,
+		oidc.Nonce(login.nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	return authURL, state, nil
+}
+
+// Exchange trades the code the provider redirected back with for a
+// verified ID token, and maps its claims to a pcbook user.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, state string) (*OIDCIdentity, error) {
+	p.mutex.Lock()
+	login := p.removePending(state)
+	p.mutex.Unlock()
+
+	if login == nil || time.Now().After(login.expiresAt) {
+		return nil, ErrOIDCState
+	}
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", login.codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("cant exchange OIDC code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token in OIDC token response")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC id token: %w", err)
+	}
+	if idToken.Nonce != login.nonce {
+		return nil, fmt.Errorf("invalid OIDC id token: nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("cant read OIDC claims: %w", err)
+	}
+
+	username, _ := claims[p.config.UsernameClaim].(string)
+	if len(username) == 0 {
+		return nil, fmt.Errorf("no %v claim in OIDC id token", p.config.UsernameClaim)
+	}
+
+	role, ok := p.role(claims[p.config.GroupsClaim])
+	if !ok {
+		return nil, ErrOIDCNoRole
+	}
+
+	return &OIDCIdentity{
+		ExternalID: idToken.Issuer + "|" + idToken.Subject,
+		Username:   username,
+		Role:       role,
+	}, nil
+}
+
+// removePending forgets the login of state and returns it, nil if unknown.
+func (p *OIDCProvider) removePending(state string) *pendingOIDCLogin {
+	login := p.pending[state]
+	if login == nil {
+		return nil
+	}
+	p.order.Remove(login.element)
+	delete(p.pending, state)
+	return login
+}
+
+func (p *OIDCProvider) role(groupsClaim interface{}) (string, bool) {
+	groups := make(map[string]bool)
+	switch value := groupsClaim.(type) {
+	case string:
+		groups[value] = true
+	case []interface{}:
+		for _, group := range value {
+			if name, ok := group.(string); ok {
+				groups[name] = true
+			}
+		}
+	}
+
+	for _, mapping := range p.config.Roles {
+		if groups[mapping.Group] {
+			return mapping.Role, true
+		}
+	}
+
+	return p.config.DefaultRole, len(p.config.DefaultRole) > 0
+}
+
+func randomToken() (string, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", fmt.Errorf("cant create random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
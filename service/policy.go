@@ -0,0 +1,366 @@
+package service
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy tells which role may call which gRPC method. A rule matches a full
+// method name ("/pb.LaptopService/CreateLaptop"), every method of a service
+// ("/pb.LaptopService/*") or every method ("*"); the most specific wins.
+// The rules declared in the proto files with the pcbook.auth.access option
+// come after the full method rules of the file and before its wildcards.
+type Policy struct {
+	// DefaultDeny rejects the methods without a rule, otherwise they are
+	// public.
+	DefaultDeny bool                `yaml:"default_deny" json:"default_deny"`
+	Permissions []string            `yaml:"permissions" json:"permissions"`
+	Roles       map[string][]string `yaml:"roles" json:"roles"`
+	Rules       []PolicyRule        `yaml:"rules" json:"rules"`
+	// PeerCertificates authenticate service-to-service callers by their
+	// verified TLS client certificate instead of a token.
+	PeerCertificates []PeerCertificate `yaml:"peer_certificates" json:"peer_certificates"`
+
+	rules      map[string]*PolicyRule
+	protoRules map[string]*PolicyRule
+}
+
+type PolicyRule struct {
+	Method string `yaml:"method" json:"method"`
+	// Public methods need no token.
+	Public bool `yaml:"public" json:"public"`
+	// Permission a role must grant to call the method.
+	Permission string `yaml:"permission" json:"permission"`
+	// Roles allowed to call the method, instead of a permission.
+	Roles []string `yaml:"roles" json:"roles"`
+}
+
+// PeerCertificate maps a client certificate to a role. It matches either
+// the subject common name or a SAN URI, such as a SPIFFE ID.
+type PeerCertificate struct {
+	CommonName string `yaml:"common_name" json:"common_name"`
+	URI        string `yaml:"uri" json:"uri"`
+	Role       string `yaml:"role" json:"role"`
+	// Tenant the caller works on, DefaultTenant if empty.
+	Tenant string `yaml:"tenant" json:"tenant"`
+}
+
+// Username is the name the caller gets in its claims. The prefix keeps it
+// apart from the accounts, which cant contain ":".
+func (c *PeerCertificate) Username() string {
+	if len(c.URI) > 0 {
+		return "cert:" + c.URI
+	}
+	return "cert:" + c.CommonName
+}
+
+// allPermissions granted to a role gives it every permission.
+const allPermissions = "*"
+
+// LoadPolicy reads a YAML policy file. JSON being valid YAML, .json files
+// are read the same way.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	err = yaml.Unmarshal(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("cant parse policy %v: %w", path, err)
+	}
+
+	err = policy.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %v: %w", path, err)
+	}
+
+	return policy, nil
+}
+
+// Validate checks every role and rule refers to a declared permission and
+// indexes the rules. It must be called before using the policy.
+func (p *Policy) Validate() error {
+	declared := make(map[string]bool)
+	for _, permission := range p.Permissions {
+		declared[permission] = true
+	}
+
+	for role, permissions := range p.Roles {
+		for _, permission := range permissions {
+			if permission != allPermissions && !declared[permission] {
+				return fmt.Errorf("role %v has undeclared permission %q", role, permission)
+			}
+		}
+	}
+
+	p.rules = make(map[string]*PolicyRule)
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+
+		err := validateMethodPattern(rule.Method)
+		if err != nil {
+			return err
+		}
+		if _, exist := p.rules[rule.Method]; exist {
+			return fmt.Errorf("method %v has more than one rule", rule.Method)
+		}
+		err = validateRuleKind(rule)
+		if err != nil {
+			return err
+		}
+		if len(rule.Permission) > 0 && !declared[rule.Permission] {
+			return fmt.Errorf("method %v has undeclared permission %q", rule.Method, rule.Permission)
+		}
+
+		p.rules[rule.Method] = rule
+	}
+
+	identities := make(map[string]bool)
+	for i := range p.PeerCertificates {
+		peerCert := &p.PeerCertificates[i]
+		if (len(peerCert.CommonName) > 0) == (len(peerCert.URI) > 0) {
+			return fmt.Errorf("peer certificate %d needs exactly one of common_name or uri", i)
+		}
+		if len(peerCert.Role) == 0 {
+			return fmt.Errorf("peer certificate %v has no role", peerCert.Username())
+		}
+		if peerCert.Tenant != DefaultTenant {
+			err := ValidateTenantID(peerCert.Tenant)
+			if err != nil {
+				return fmt.Errorf("peer certificate %v: %w", peerCert.Username(), err)
+			}
+		}
+		if identities[peerCert.Username()] {
+			return fmt.Errorf("peer certificate %v is mapped more than once", peerCert.Username())
+		}
+		identities[peerCert.Username()] = true
+	}
+
+	return nil
+}
+
+// PeerCertificate returns the mapping of a verified client certificate.
+// The SAN URIs are tried before the common name.
+func (p *Policy) PeerCertificate(cert *x509.Certificate) (*PeerCertificate, bool) {
+	for _, uri := range cert.URIs {
+		for i := range p.PeerCertificates {
+			if len(p.PeerCertificates[i].URI) > 0 && p.PeerCertificates[i].URI == uri.String() {
+				return &p.PeerCertificates[i], true
+			}
+		}
+	}
+
+	if len(cert.Subject.CommonName) == 0 {
+		return nil, false
+	}
+	for i := range p.PeerCertificates {
+		if p.PeerCertificates[i].CommonName == cert.Subject.CommonName {
+			return &p.PeerCertificates[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Rule returns the rule applying to the full method name.
+func (p *Policy) Rule(method string) (*PolicyRule, bool) {
+	if rule, ok := p.rules[method]; ok {
+		return rule, true
+	}
+
+	if rule, ok := p.protoRules[method]; ok {
+		return rule, true
+	}
+
+	if i := strings.LastIndex(method, "/"); i > 0 {
+		if rule, ok := p.rules[method[:i+1]+"*"]; ok {
+			return rule, true
+		}
+	}
+
+	rule, ok := p.rules["*"]
+	return rule, ok
+}
+
+// Permits tells if the role may call the method of the rule.
+func (p *Policy) Permits(rule *PolicyRule, role string) bool {
+	if rule.Public {
+		return true
+	}
+
+	for _, allowed := range rule.Roles {
+		if strings.EqualFold(allowed, role) {
+			return true
+		}
+	}
+
+	return len(rule.Permission) > 0 && p.Allows(role, rule.Permission)
+}
+
+// Allows tells if the role grants the permission. Roles are case insensitive.
+func (p *Policy) Allows(role string, permission string) bool {
+	for name, permissions := range p.Roles {
+		if !strings.EqualFold(name, role) {
+			continue
+		}
+		for _, granted := range permissions {
+			if granted == permission || granted == allPermissions {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MissingMethods returns the methods no rule applies to.
+func (p *Policy) MissingMethods(methods []string) []string {
+	var missing []string
+	for _, method := range methods {
+		if _, ok := p.Rule(method); !ok {
+			missing = append(missing, method)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// withProtoRules returns a copy of the validated policy using the rules.
+func (p *Policy) withProtoRules(rules map[string]*PolicyRule) *Policy {
+	policy := *p
+	policy.protoRules = rules
+	return &policy
+}
+
+func validateRuleKind(rule *PolicyRule) error {
+	kinds := 0
+	if rule.Public {
+		kinds++
+	}
+	if len(rule.Permission) > 0 {
+		kinds++
+	}
+	if len(rule.Roles) > 0 {
+		kinds++
+	}
+
+	if kinds != 1 {
+		return fmt.Errorf("method %v needs exactly one of public, permission or roles", rule.Method)
+	}
+	return nil
+}
+
+func validateMethodPattern(method string) error {
+	if method == "*" {
+		return nil
+	}
+
+	parts := strings.Split(method, "/")
+	if len(parts) != 3 || len(parts[0]) != 0 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return fmt.Errorf("invalid method %q, expect /package.Service/Method, /package.Service/* or *", method)
+	}
+
+	return nil
+}
+
+// PolicyManager holds the policy in use and swaps it on Reload.
+type PolicyManager struct {
+	path       string
+	mutex      sync.RWMutex
+	policy     *Policy
+	methods    []string
+	protoRules map[string]*PolicyRule
+}
+
+// NewPolicyManager serves a fixed policy, Reload is a no-op.
+func NewPolicyManager(policy *Policy) (*PolicyManager, error) {
+	err := policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyManager{policy: policy}, nil
+}
+
+// LoadPolicyManager serves the policy file, Reload reads it again.
+func LoadPolicyManager(path string) (*PolicyManager, error) {
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyManager{path: path, policy: policy}, nil
+}
+
+func (m *PolicyManager) Policy() *Policy {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.policy
+}
+
+// SetProtoRules adds the rules declared in the proto files to the policy,
+// see ProtoAccessRules. They are kept across reloads.
+func (m *PolicyManager) SetProtoRules(rules []PolicyRule) error {
+	protoRules := make(map[string]*PolicyRule)
+	for i := range rules {
+		rule := &rules[i]
+		err := validateRuleKind(rule)
+		if err != nil {
+			return err
+		}
+		protoRules[rule.Method] = rule
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.protoRules = protoRules
+	m.policy = m.policy.withProtoRules(protoRules)
+	return nil
+}
+
+// RequireMethods checks the policy has a rule for every method, and makes
+// Reload refuse a policy that does not.
+func (m *PolicyManager) RequireMethods(methods []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	missing := m.policy.MissingMethods(methods)
+	if len(missing) > 0 {
+		return fmt.Errorf("no policy rule for methods %v", missing)
+	}
+
+	m.methods = methods
+	return nil
+}
+
+// Reload reads the policy file again. The current policy is kept when the
+// file is invalid.
+func (m *PolicyManager) Reload() error {
+	if len(m.path) == 0 {
+		return nil
+	}
+
+	policy, err := LoadPolicy(m.path)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	policy = policy.withProtoRules(m.protoRules)
+	missing := policy.MissingMethods(m.methods)
+	if len(missing) > 0 {
+		return fmt.Errorf("no policy rule for methods %v", missing)
+	}
+
+	m.policy = policy
+	return nil
+}
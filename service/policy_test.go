@@ -0,0 +1,219 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// newTestPolicy returns a default deny policy with the given method to
+// permission rules. Admins have every permission, users all but laptop.write.
+func newTestPolicy(t *testing.T, rules map[string]string) *service.PolicyManager {
+	policy := &service.Policy{
+		DefaultDeny: true,
+		Permissions: []string{"laptop.read", "laptop.write", "account.self"},
+		Roles: map[string][]string{
+			"admin": {"*"},
+			"user":  {"laptop.read", "account.self"},
+		},
+	}
+	for method, permission := range rules {
+		policy.Rules = append(policy.Rules, service.PolicyRule{Method: method, Permission: permission})
+	}
+
+	manager, err := service.NewPolicyManager(policy)
+	require.NoError(t, err)
+	return manager
+}
+
+func TestPolicyRules(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	err := os.WriteFile(path, []byte(`
+default_deny: true
+permissions: [laptop.read, laptop.write]
+roles:
+  admin: ["*"]
+  user: [laptop.read]
+rules:
+  - method: /pb.LaptopService/*
+    permission: laptop.write
+  - method: /pb.LaptopService/SearchLaptop
+    permission: laptop.read
+  - method: /pb.AuthService/Login
+    public: true
+`), 0o600)
+	require.NoError(t, err)
+
+	manager, err := service.LoadPolicyManager(path)
+	require.NoError(t, err)
+	policy := manager.Policy()
+
+	rule, ok := policy.Rule("/pb.LaptopService/SearchLaptop")
+	require.True(t, ok)
+	require.Equal(t, "laptop.read", rule.Permission)
+	require.True(t, policy.Allows("user", rule.Permission))
+
+	// the service wildcard covers the methods without their own rule
+	rule, ok = policy.Rule("/pb.LaptopService/CreateLaptop")
+	require.True(t, ok)
+	require.Equal(t, "laptop.write", rule.Permission)
+	require.False(t, policy.Allows("user", rule.Permission))
+	require.True(t, policy.Allows("ADMIN", rule.Permission))
+
+	rule, ok = policy.Rule("/pb.AuthService/Login")
+	require.True(t, ok)
+	require.True(t, rule.Public)
+
+	_, ok = policy.Rule("/pb.AuthService/GetMe")
+	require.False(t, ok)
+
+	err = manager.RequireMethods([]string{"/pb.LaptopService/RateLaptop", "/pb.AuthService/GetMe"})
+	require.ErrorContains(t, err, "/pb.AuthService/GetMe")
+	require.NoError(t, manager.RequireMethods([]string{"/pb.LaptopService/RateLaptop", "/pb.AuthService/Login"}))
+
+	// a reload dropping a required method is refused
+	err = os.WriteFile(path, []byte(`
+permissions: [laptop.read]
+roles:
+  user: [laptop.read]
+rules:
+  - method: /pb.LaptopService/SearchLaptop
+    permission: laptop.read
+`), 0o600)
+	require.NoError(t, err)
+	require.Error(t, manager.Reload())
+	require.Same(t, policy, manager.Policy())
+
+	// JSON is read as well
+	err = os.WriteFile(path, []byte(`{
+		"permissions": ["laptop.read"],
+		"roles": {"user": ["laptop.read"]},
+		"rules": [{"method": "*", "permission": "laptop.read"}]
+	}`), 0o600)
+	require.NoError(t, err)
+	require.NoError(t, manager.Reload())
+	rule, ok = manager.Policy().Rule("/pb.AuthService/Login")
+	require.True(t, ok)
+	require.Equal(t, "laptop.read", rule.Permission)
+}
+
+func TestPolicyValidate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		policy service.Policy
+	}{
+		{
+			name: "undeclaredRolePermission",
+			policy: service.Policy{
+				Roles: map[string][]string{"user": {"laptop.read"}},
+			},
+		},
+		{
+			name: "undeclaredRulePermission",
+			policy: service.Policy{
+				Rules: []service.PolicyRule{{Method: "*", Permission: "laptop.read"}},
+			},
+		},
+		{
+			name: "publicWithPermission",
+			policy: service.Policy{
+				Permissions: []string{"laptop.read"},
+				Rules:       []service.PolicyRule{{Method: "*", Public: true, Permission: "laptop.read"}},
+			},
+		},
+		{
+			name: "invalidMethod",
+			policy: service.Policy{
+				Rules: []service.PolicyRule{{Method: "pb.LaptopService.CreateLaptop", Public: true}},
+			},
+		},
+		{
+			name: "duplicateRule",
+			policy: service.Policy{
+				Rules: []service.PolicyRule{{Method: "*", Public: true}, {Method: "*", Public: true}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		tc := test
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require.Error(t, tc.policy.Validate())
+		})
+	}
+}
+
+func TestPolicyProtoRules(t *testing.T) {
+	t.Parallel()
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopServer(nil, nil, nil))
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(nil, nil, nil, nil, nil))
+
+	rules, err := service.ProtoAccessRules(grpcServer.GetServiceInfo())
+	require.NoError(t, err)
+
+	manager, err := service.NewPolicyManager(&service.Policy{
+		DefaultDeny: true,
+		Permissions: []string{"laptop.write"},
+		Roles:       map[string][]string{"admin": {"laptop.write"}},
+		Rules: []service.PolicyRule{
+			{Method: "/pb.LaptopService/*", Public: true},
+			{Method: "/pb.LaptopService/DeleteLaptop", Permission: "laptop.write"},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProtoRules(rules))
+	policy := manager.Policy()
+
+	rule, ok := policy.Rule("/pb.LaptopService/CreateLaptop")
+	require.True(t, ok)
+	require.Equal(t, []string{service.SuperAdminRole, "admin"}, rule.Roles)
+	require.True(t, policy.Permits(rule, "admin"))
+	require.False(t, policy.Permits(rule, "user"))
+
+	rule, ok = policy.Rule("/pb.LaptopService/SearchLaptop")
+	require.True(t, ok)
+	require.True(t, policy.Permits(rule, "user"))
+
+	rule, ok = policy.Rule("/pb.AuthService/Login")
+	require.True(t, ok)
+	require.True(t, rule.Public)
+
+	// a full method rule of the file overrides the proto option
+	rule, ok = policy.Rule("/pb.LaptopService/DeleteLaptop")
+	require.True(t, ok)
+	require.Equal(t, "laptop.write", rule.Permission)
+
+	methods := []string{"/pb.LaptopService/CreateLaptop", "/pb.AuthService/GetMe", "/pb.AuthService/Logout"}
+	require.NoError(t, manager.RequireMethods(methods))
+}
+
+func TestPolicyPeerCertificateValidate(t *testing.T) {
+	t.Parallel()
+
+	invalid := [][]service.PeerCertificate{
+		{{Role: "admin"}},
+		{{CommonName: "a", URI: "spiffe://a", Role: "admin"}},
+		{{CommonName: "a"}},
+		{{CommonName: "a", Role: "admin"}, {CommonName: "a", Role: "user"}},
+		{{CommonName: "a", Role: "admin", Tenant: "../x"}},
+	}
+	for _, peerCertificates := range invalid {
+		policy := &service.Policy{PeerCertificates: peerCertificates}
+		require.Error(t, policy.Validate())
+	}
+
+	policy := &service.Policy{PeerCertificates: []service.PeerCertificate{{CommonName: "a", Role: "admin", Tenant: "acme"}}}
+	require.NoError(t, policy.Validate())
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// ProtoAccessRules reads the pcbook.auth.access option of every method of
+// the registered services. Methods without the option are left to the
+// policy file.
+func ProtoAccessRules(services map[string]grpc.ServiceInfo) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	for name := range services {
+		desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, fmt.Errorf("cant find descriptor of service %v: %w", name, err)
+		}
+
+		serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a service", name)
+		}
+
+		methods := serviceDesc.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			method := methods.Get(i)
+			options, ok := method.Options().(*descriptorpb.MethodOptions)
+			if !ok || !proto.HasExtension(options, pb.E_Access) {
+				continue
+			}
+
+			access := proto.GetExtension(options, pb.E_Access).(*pb.AccessRule)
+			rules = append(rules, PolicyRule{
+				Method: fmt.Sprintf("/%v/%v", name, method.Name()),
+				Public: access.GetPublic(),
+				Roles:  access.GetRoles(),
+			})
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// streamRetryDelay is suggested to a caller over its stream limit, there is
+// no telling when one of its streams ends.
+const streamRetryDelay = time.Second
+
+// rateLimiterSweepInterval is how often the idle buckets are forgotten.
+const rateLimiterSweepInterval = time.Minute
+
+// RateLimit is a token bucket: Rate calls per second, up to Burst at once.
+// Rate must be positive.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits apply to every caller on its own. Like the policy rules,
+// "/package.Service/*" matches every method of a service, and "*" the
+// methods matching nothing else. A method matching no entry is not limited.
+type RateLimits struct {
+	Methods map[string]RateLimit
+	// Peer limits every peer IP, all methods together, Rate 0 for no limit.
+	Peer RateLimit
+	// MaxStreams a caller may keep open at once, 0 for no limit.
+	MaxStreams int
+}
+
+var DefaultRateLimits = RateLimits{
+	Methods: map[string]RateLimit{
+		"*":                              {Rate: 50, Burst: 100},
+		"/pb.LaptopService/CreateLaptop": {Rate: 5, Burst: 20},
+		"/pb.LaptopService/UploadImage":  {Rate: 1, Burst: 5},
+		"/pb.LaptopService/RateLaptop":   {Rate: 1, Burst: 5},
+	},
+	Peer:       RateLimit{Rate: 100, Burst: 200},
+	MaxStreams: 10,
+}
+
+// RateLimiter rejects the calls over the limits of their method with
+// ResourceExhausted and a RetryInfo detail. The caller is the user of the
+// token, the API key, or the peer IP for the public methods, so Unary and
+// Stream must run after the AuthInterceptor. PeerUnary and PeerStream run
+// before it, so that the calls with a bad token are limited too.
+type RateLimiter struct {
+	limits    RateLimits
+	mutex     sync.Mutex
+	buckets   map[string]*rateBucket
+	streams   map[string]int
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	limiter *rate.Limiter
+	// full is when the bucket is back to its burst at the latest, and can
+	// be forgotten.
+	full time.Time
+}
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:    limits,
+		buckets:   make(map[string]*rateBucket),
+		streams:   make(map[string]int),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *RateLimiter) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		err := l.allow(rateLimitCaller(ctx), info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (l *RateLimiter) Stream() grpc.StreamServerInterceptor {
+	return func(server interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		caller := rateLimitCaller(stream.Context())
+		err := l.allow(caller, info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		err = l.openStream(caller)
+		if err != nil {
+			return err
+		}
+		defer l.closeStream(caller)
+
+		return handler(server, stream)
+	}
+}
+
+// PeerUnary limits the calls of every peer IP to the Peer limit.
+func (l *RateLimiter) PeerUnary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		err := l.allowPeer(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// PeerStream limits the streams opened by every peer IP to the Peer limit.
+func (l *RateLimiter) PeerStream() grpc.StreamServerInterceptor {
+	return func(server interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		err := l.allowPeer(stream.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(server, stream)
+	}
+}
+
+// allow takes a token from the bucket of the caller for method.
+func (l *RateLimiter) allow(caller string, method string) error {
+	pattern, limit, ok := l.methodLimit(method)
+	if !ok {
+		return nil
+	}
+	return l.take(caller+" "+pattern, limit, method)
+}
+
+// allowPeer takes a token from the bucket of the peer IP, shared by all
+// methods.
+func (l *RateLimiter) allowPeer(ctx context.Context, method string) error {
+	if l.limits.Peer.Rate <= 0 {
+		return nil
+	}
+	return l.take("ip:"+peerIP(ctx), l.limits.Peer, method)
+}
+
+// take takes a token from the bucket under key, created with limit.
+func (l *RateLimiter) take(key string, limit RateLimit, method string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket := l.buckets[key]
+	if bucket == nil {
+		bucket = &rateBucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		l.buckets[key] = bucket
+	}
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return rateLimitError(streamRetryDelay, "%v allows no call", method)
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return rateLimitError(delay, "too many calls to %v, retry in %v", method, delay.Round(time.Millisecond))
+	}
+
+	bucket.full = now.Add(time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second)))
+	return nil
+}
+
+func (l *RateLimiter) openStream(caller string) error {
+	if l.limits.MaxStreams <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.streams[caller] >= l.limits.MaxStreams {
+		return rateLimitError(streamRetryDelay, "too many open streams, at most %v", l.limits.MaxStreams)
+	}
+	l.streams[caller]++
+	return nil
+}
+
+func (l *RateLimiter) closeStream(caller string) {
+	if l.limits.MaxStreams <= 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.streams[caller]--
+	if l.streams[caller] <= 0 {
+		delete(l.streams, caller)
+	}
+}
+
+func (l *RateLimiter) methodLimit(method string) (pattern string, limit RateLimit, ok bool) {
+	patterns := []string{method}
+	if j := strings.LastIndex(method, "/"); j > 0 {
+		patterns = append(patterns, method[:j+1]+"*")
+	}
+	patterns = append(patterns, "*")
+
+	for _, pattern := range patterns {
+		if limit, ok := l.limits.Methods[pattern]; ok {
+			return pattern, limit, true
+		}
+	}
+	return "", RateLimit{}, false
+}
+
+// sweep forgets the full buckets, a new one would be the same.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if now.After(bucket.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitCaller returns the key the limits of the call are counted
+// under.
+func rateLimitCaller(ctx context.Context) string {
+	claims := UserClaimsFromContext(ctx)
+	switch {
+	case claims != nil && claims.TokenType == APIKeyTokenType:
+		return "key:" + claims.Id
+	case claims != nil:
+		return "user:" + claims.Tenant + "/" + claims.Username
+	default:
+		return "peer:" + peerIP(ctx)
+	}
+}
+
+func rateLimitError(retryDelay time.Duration, format string, args ...interface{}) error {
+	st := status.Newf(codes.ResourceExhausted, format, args...)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,176 @@
+package service_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiterUnary(t *testing.T) {
+	t.Parallel()
+
+	limiter := service.NewRateLimiter(service.RateLimits{
+		Methods: map[string]service.RateLimit{
+			"/pb.LaptopService/CreateLaptop": {Rate: 0.01, Burst: 2},
+			"/pb.AuthService/*":              {Rate: 0.01, Burst: 1},
+		},
+	})
+
+	user1 := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "user1", Tenant: "acme"})
+	user2 := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "user2", Tenant: "acme"})
+	anonymous := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4242}})
+
+	call := func(ctx context.Context, method string) error {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := limiter.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+
+	require.NoError(t, call(user1, "/pb.LaptopService/CreateLaptop"))
+	require.NoError(t, call(user1, "/pb.LaptopService/CreateLaptop"))
+	err := call(user1, "/pb.LaptopService/CreateLaptop")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+	retryInfo, ok := details[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	require.Greater(t, retryInfo.GetRetryDelay().AsDuration().Seconds(), 50.0)
+
+	// every caller and every method has its own bucket
+	require.NoError(t, call(user2, "/pb.LaptopService/CreateLaptop"))
+	require.NoError(t, call(anonymous, "/pb.AuthService/Login"))
+	require.Equal(t, codes.ResourceExhausted, status.Code(call(anonymous, "/pb.AuthService/Register")))
+	require.NoError(t, call(user1, "/pb.LaptopService/SearchLaptop"))
+}
+
+func TestRateLimiterStreams(t *testing.T) {
+	t.Parallel()
+
+	limiter := service.NewRateLimiter(service.RateLimits{MaxStreams: 1})
+	user1 := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "user1"})
+	user2 := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "user2"})
+	info := &grpc.StreamServerInfo{FullMethod: "/pb.LaptopService/RateLaptop"}
+
+	open := func(ctx context.Context, handler grpc.StreamHandler) error {
+		return limiter.Stream()(nil, &claimsServerStream{ctx: ctx}, info, handler)
+	}
+	done := func(srv interface{}, stream grpc.ServerStream) error {
+		return nil
+	}
+
+	err := open(user1, func(srv interface{}, stream grpc.ServerStream) error {
+		// user1 already has a stream open
+		err := open(user1, done)
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Len(t, status.Convert(err).Details(), 1)
+
+		return open(user2, done)
+	})
+	require.NoError(t, err)
+
+	// the stream is closed
+	require.NoError(t, open(user1, done))
+}
+
+func TestRateLimiterPeer(t *testing.T) {
+	t.Parallel()
+
+	limiter := service.NewRateLimiter(service.RateLimits{
+		Peer: service.RateLimit{Rate: 0.01, Burst: 2},
+	})
+	fromIP := func(ip net.IP) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: ip, Port: 4242}})
+	}
+	call := func(ctx context.Context, method string) error {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := limiter.PeerUnary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+	stream := func(ctx context.Context) error {
+		info := &grpc.StreamServerInfo{FullMethod: "/pb.LaptopService/SearchLaptop"}
+		return limiter.PeerStream()(nil, &claimsServerStream{ctx: ctx}, info, func(srv interface{}, stream grpc.ServerStream) error {
+			return nil
+		})
+	}
+
+	// the calls and streams of a peer share its bucket
+	attacker := fromIP(net.IPv4(10, 1, 2, 3))
+	require.NoError(t, call(attacker, "/pb.LaptopService/CreateLaptop"))
+	require.NoError(t, stream(attacker))
+	require.Equal(t, codes.ResourceExhausted, status.Code(call(attacker, "/pb.AuthService/Login")))
+	require.Equal(t, codes.ResourceExhausted, status.Code(stream(attacker)))
+
+	require.NoError(t, call(fromIP(net.IPv4(10, 1, 2, 4)), "/pb.AuthService/Login"))
+
+	// no peer limit
+	limiter = service.NewRateLimiter(service.RateLimits{})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, call(attacker, "/pb.AuthService/Login"))
+	}
+}
+
+func TestRateLimiterFallback(t *testing.T) {
+	t.Parallel()
+
+	limiter := service.NewRateLimiter(service.RateLimits{
+		Methods: map[string]service.RateLimit{
+			"*":                              {Rate: 0.01, Burst: 1},
+			"/pb.LaptopService/*":            {Rate: 0.01, Burst: 2},
+			"/pb.LaptopService/CreateLaptop": {Rate: 0.01, Burst: 3},
+		},
+	})
+	user1 := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "user1"})
+	calls := func(method string) int {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		for i := 0; ; i++ {
+			_, err := limiter.Unary()(user1, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			})
+			if err != nil {
+				require.Equal(t, codes.ResourceExhausted, status.Code(err))
+				return i
+			}
+		}
+	}
+
+	require.Equal(t, 3, calls("/pb.LaptopService/CreateLaptop"))
+	require.Equal(t, 2, calls("/pb.LaptopService/SearchLaptop"))
+	// the methods of a service share its bucket
+	require.Equal(t, 0, calls("/pb.LaptopService/UploadImage"))
+	require.Equal(t, 1, calls("/pb.AuthService/Login"))
+	require.Equal(t, 0, calls("/pb.AuditService/QueryAuditLog"))
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	t.Parallel()
+
+	limiter := service.NewRateLimiter(service.RateLimits{
+		Methods: map[string]service.RateLimit{"*": {Rate: 10, Burst: 2}},
+	})
+	info := &grpc.UnaryServerInfo{FullMethod: "/pb.LaptopService/CreateLaptop"}
+	for _, username := range []string{"user1", "user2"} {
+		ctx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: username})
+		_, err := limiter.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		require.NoError(t, err)
+	}
+
+	// the buckets are full again after burst / rate = 200ms
+	require.Equal(t, 2, limiter.SweepAt(time.Now()))
+	require.Equal(t, 0, limiter.SweepAt(time.Now().Add(time.Second)))
+}
@@ -1,9 +1,14 @@
 package service
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
+// RatingStore keeps the ratings of the laptops, scoped by the tenant of the
+// caller like LaptopStore.
 type RatingStore interface {
-	Add(laptopID string, score float64) (*Rating, error)
+	Add(ctx context.Context, laptopID string, score float64) (*Rating, error)
 }
 
 type Rating struct {
@@ -11,30 +16,49 @@ type Rating struct {
 	Sum   float64
 }
 
+type ratingKey struct {
+	tenant   string
+	laptopID string
+}
+
 type InMemoryRatingStore struct {
 	m      sync.RWMutex
-	rating map[string]*Rating
+	rating map[ratingKey]*Rating
 }
 
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(ctx context.Context, laptopID string, score float64) (*Rating, error) {
+	key := ratingKey{tenant: TenantFromContext(ctx), laptopID: laptopID}
+
 	store.m.Lock()
 	defer store.m.Unlock()
 
-	exist, ok := store.rating[laptopID]
+	exist, ok := store.rating[key]
 	if ok {
 		rating := exist
 		rating.Count += 1
 		rating.Sum += score
-		store.rating[laptopID] = rating
+		store.rating[key] = rating
 	} else {
-		store.rating[laptopID] = &Rating{Count: 1, Sum: score}
+		store.rating[key] = &Rating{Count: 1, Sum: score}
 	}
 
-	return store.rating[laptopID], nil
+	return store.rating[key], nil
+}
+
+// Count returns the number of ratings of every tenant.
+func (store *InMemoryRatingStore) Count() int {
+	store.m.RLock()
+	defer store.m.RUnlock()
+
+	count := 0
+	for _, rating := range store.rating {
+		count += int(rating.Count)
+	}
+	return count
 }
 
-func NewInMemoryRatingStore() RatingStore {
+func NewInMemoryRatingStore() *InMemoryRatingStore {
 	return &InMemoryRatingStore{
-		rating: make(map[string]*Rating),
+		rating: make(map[ratingKey]*Rating),
 	}
 }
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationStore keeps the IDs (jti) of tokens revoked before they expire.
+type RevocationStore interface {
+	Revoke(jti string, expiresAt time.Time) error
+	// RevokeIfNotRevoked revokes jti and returns true, or returns false if
+	// it was already revoked, in one step so a token is revoked only once.
+	RevokeIfNotRevoked(jti string, expiresAt time.Time) (bool, error)
+	IsRevoked(jti string) (bool, error)
+}
+
+type InMemoryRevocationStore struct {
+	mutex   sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func NewInMemoryRevocationStore() *InMemoryRevocationStore {
+	return &InMemoryRevocationStore{
+		revoked: make(map[string]time.Time),
+	}
+}
+
+func (store *InMemoryRevocationStore) Revoke(jti string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.forgetExpired()
+	store.revoked[jti] = expiresAt
+	return nil
+}
+
+func (store *InMemoryRevocationStore) RevokeIfNotRevoked(jti string, expiresAt time.Time) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, revoked := store.revoked[jti]; revoked {
+		return false, nil
+	}
+
+	store.forgetExpired()
+	store.revoked[jti] = expiresAt
+	return true, nil
+}
+
+func (store *InMemoryRevocationStore) IsRevoked(jti string) (bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	_, revoked := store.revoked[jti]
+	return revoked, nil
+}
+
+// forgetExpired drops the expired tokens, they are rejected anyway.
+func (store *InMemoryRevocationStore) forgetExpired() {
+	now := time.Now()
+	for id, expires := range store.revoked {
+		if expires.Before(now) {
+			delete(store.revoked, id)
+		}
+	}
+}
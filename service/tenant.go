@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// DefaultTenant holds the catalog of the users without a tenant.
+const DefaultTenant = ""
+
+var (
+	ErrInvalidTenant = errors.New("invalid tenant")
+
+	tenantPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{1,31}$`)
+)
+
+// Tenant is a reseller with its own catalog. Laptops, images and ratings
+// of a tenant are invisible to the others.
+type Tenant struct {
+	ID   string
+	Name string
+}
+
+// ValidateTenantID accepts 2 to 32 lowercase letters, digits or "-",
+// starting with a letter. Tenant IDs are used as folder names.
+func ValidateTenantID(id string) error {
+	if !tenantPattern.MatchString(id) {
+		return fmt.Errorf("%w: use 2-32 lowercase letters, digits or -, starting with a letter", ErrInvalidTenant)
+	}
+	return nil
+}
+
+// TenantFromContext returns the tenant of the caller, the stores scope
+// every operation by it.
+func TenantFromContext(ctx context.Context) string {
+	claims := UserClaimsFromContext(ctx)
+	if claims == nil {
+		return DefaultTenant
+	}
+	return claims.Tenant
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"sort"
+	"sync"
+)
+
+type TenantStore interface {
+	Save(tenant *Tenant) error
+	Find(id string) (*Tenant, error)
+	// List returns the tenants ordered by ID.
+	List() ([]*Tenant, error)
+}
+
+type InMemoryTenantStore struct {
+	tenants map[string]*Tenant
+	mutex   sync.RWMutex
+}
+
+func NewInMemoryTenantStore() *InMemoryTenantStore {
+	return &InMemoryTenantStore{
+		tenants: make(map[string]*Tenant),
+	}
+}
+
+func (store *InMemoryTenantStore) Save(tenant *Tenant) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tenants[tenant.ID] != nil {
+		return ErrAlreadyExist
+	}
+
+	clone := *tenant
+	store.tenants[tenant.ID] = &clone
+	return nil
+}
+
+func (store *InMemoryTenantStore) Find(id string) (*Tenant, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	tenant := store.tenants[id]
+	if tenant == nil {
+		return nil, ErrNotExist
+	}
+
+	clone := *tenant
+	return &clone, nil
+}
+
+func (store *InMemoryTenantStore) List() ([]*Tenant, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	tenants := make([]*Tenant, 0, len(store.tenants))
+	for _, tenant := range store.tenants {
+		clone := *tenant
+		tenants = append(tenants, &clone)
+	}
+	sort.Slice(tenants, func(a, b int) bool {
+		return tenants[a].ID < tenants[b].ID
+	})
+
+	return tenants, nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterOTLP   = "otlp"
+)
+
+var tracer = otel.Tracer("github.com/TranQuocToan1996/go-pcBookgRPC/service")
+
+type TracingConfig struct {
+	ServiceName string
+	// Exporter is TraceExporterNone, TraceExporterStdout or
+	// TraceExporterOTLP.
+	Exporter string
+	// OTLPEndpoint is the host:port of the OTLP gRPC collector, the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable if empty.
+	OTLPEndpoint string
+	OTLPInsecure bool
+	// SampleRatio of the traces started here, the others follow the
+	// decision of the caller.
+	SampleRatio float64
+}
+
+// SetupTracing installs the global tracer provider and the W3C trace
+// context propagator. Without exporter the trace context is still passed
+// on, but no span is recorded. shutdown flushes the spans left.
+func SetupTracing(ctx context.Context, config TracingConfig) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case TraceExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New()
+	case TraceExporterOTLP:
+		var options []otlptracegrpc.Option
+		if len(config.OTLPEndpoint) > 0 {
+			options = append(options, otlptracegrpc.WithEndpoint(config.OTLPEndpoint))
+		}
+		if config.OTLPInsecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expect %v, %v or %v",
+			config.Exporter, TraceExporterNone, TraceExporterStdout, TraceExporterOTLP)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant create %v trace exporter: %w", config.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(config.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// EndSpan marks the span failed when err is set, then ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
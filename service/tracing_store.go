@@ -0,0 +1,123 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	laptopIDKey = attribute.Key("pcbook.laptop_id")
+	tenantKey   = attribute.Key("pcbook.tenant")
+)
+
+// TracedLaptopStore records a span for every call to the laptop store.
+type TracedLaptopStore struct {
+	store LaptopStore
+}
+
+func NewTracedLaptopStore(store LaptopStore) *TracedLaptopStore {
+	return &TracedLaptopStore{store: store}
+}
+
+func (s *TracedLaptopStore) Save(ctx context.Context, laptop *pb.Laptop) error {
+	ctx, span := startStoreSpan(ctx, "LaptopStore.Save", laptopIDKey.String(laptop.GetId()))
+	err := s.store.Save(ctx, laptop)
+	EndSpan(span, err)
+	return err
+}
+
+func (s *TracedLaptopStore) Update(ctx context.Context, laptop *pb.Laptop) error {
+	ctx, span := startStoreSpan(ctx, "LaptopStore.Update", laptopIDKey.String(laptop.GetId()))
+	err := s.store.Update(ctx, laptop)
+	EndSpan(span, err)
+	return err
+}
+
+func (s *TracedLaptopStore) Delete(ctx context.Context, id string) error {
+	ctx, span := startStoreSpan(ctx, "LaptopStore.Delete", laptopIDKey.String(id))
+	err := s.store.Delete(ctx, id)
+	EndSpan(span, err)
+	return err
+}
+
+func (s *TracedLaptopStore) Find(ctx context.Context, id string) (*pb.Laptop, error) {
+	ctx, span := startStoreSpan(ctx, "LaptopStore.Find", laptopIDKey.String(id))
+	laptop, err := s.store.Find(ctx, id)
+	EndSpan(span, err)
+	return laptop, err
+}
+
+// Search tells apart the time spent scanning the store from the time spent
+// in found, such as sending the laptops on a stream.
+func (s *TracedLaptopStore) Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error {
+	ctx, span := startStoreSpan(ctx, "LaptopStore.Search")
+
+	count := 0
+	var foundTime time.Duration
+	err := s.store.Search(ctx, filter, func(laptop *pb.Laptop) error {
+		count++
+		start := time.Now()
+		defer func() {
+			foundTime += time.Since(start)
+		}()
+		return found(laptop)
+	})
+
+	span.SetAttributes(
+		attribute.Int("pcbook.laptops_found", count),
+		attribute.Int64("pcbook.found_time_ms", foundTime.Milliseconds()),
+	)
+	EndSpan(span, err)
+	return err
+}
+
+func (s *TracedLaptopStore) Watch(ctx context.Context, since uint64) (*LaptopWatch, error) {
+	ctx, span := startStoreSpan(ctx, "LaptopStore.Watch", attribute.Int64("pcbook.since", int64(since)))
+	watch, err := s.store.Watch(ctx, since)
+	EndSpan(span, err)
+	return watch, err
+}
+
+// TracedImageStore records a span for every image saved.
+type TracedImageStore struct {
+	store ImageStore
+}
+
+func NewTracedImageStore(store ImageStore) *TracedImageStore {
+	return &TracedImageStore{store: store}
+}
+
+func (s *TracedImageStore) Save(ctx context.Context, laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+	ctx, span := startStoreSpan(ctx, "ImageStore.Save",
+		laptopIDKey.String(laptopID),
+		attribute.Int("pcbook.image_size", imageData.Len()))
+	id, err := s.store.Save(ctx, laptopID, imageType, imageData)
+	EndSpan(span, err)
+	return id, err
+}
+
+// TracedRatingStore records a span for every rating added.
+type TracedRatingStore struct {
+	store RatingStore
+}
+
+func NewTracedRatingStore(store RatingStore) *TracedRatingStore {
+	return &TracedRatingStore{store: store}
+}
+
+func (s *TracedRatingStore) Add(ctx context.Context, laptopID string, score float64) (*Rating, error) {
+	ctx, span := startStoreSpan(ctx, "RatingStore.Add", laptopIDKey.String(laptopID))
+	rating, err := s.store.Add(ctx, laptopID, score)
+	EndSpan(span, err)
+	return rating, err
+}
+
+func startStoreSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	attributes = append(attributes, tenantKey.String(TenantFromContext(ctx)))
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(attributes...))
+}
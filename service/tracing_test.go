@@ -0,0 +1,58 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/sample"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// not parallel, it sets the global tracer provider
+func TestTracedLaptopStore(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "SearchLaptop")
+	store := service.NewTracedLaptopStore(service.NewInMemoryLaptopStore())
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, store.Save(ctx, laptop))
+	_, err := store.Find(ctx, "unknown")
+	require.Error(t, err)
+
+	sent := 0
+	err = store.Search(ctx, &pb.Filter{MaxPriceUsd: 1e6}, func(laptop *pb.Laptop) error {
+		sent++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, sent)
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 4)
+
+	for _, span := range spans[:3] {
+		require.Equal(t, parent.SpanContext().TraceID(), span.SpanContext().TraceID())
+		require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+
+	require.Equal(t, "LaptopStore.Save", spans[0].Name())
+	require.Contains(t, spans[0].Attributes(), attribute.String("pcbook.laptop_id", laptop.Id))
+	require.Contains(t, spans[0].Attributes(), attribute.String("pcbook.tenant", service.DefaultTenant))
+
+	require.Equal(t, "LaptopStore.Find", spans[1].Name())
+	require.Equal(t, codes.Error, spans[1].Status().Code)
+
+	require.Equal(t, "LaptopStore.Search", spans[2].Name())
+	require.Equal(t, codes.Unset, spans[2].Status().Code)
+	require.Contains(t, spans[2].Attributes(), attribute.Int("pcbook.laptops_found", 1))
+}
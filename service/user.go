@@ -3,14 +3,79 @@ package service
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	MinPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes
+	MaxPasswordLength = 72
+)
+
+var (
+	ErrInvalidUsername = errors.New("invalid username")
+	ErrWeakPassword    = errors.New("weak password")
+
+	// passwordCost of the bcrypt hashes, the tests lower it.
+	passwordCost = bcrypt.DefaultCost
+
+	usernamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{2,31}$`)
+
+	commonPasswords = map[string]bool{
+		"password": true, "password1": true, "passw0rd": true, "12345678": true,
+		"123456789": true, "1234567890": true, "11111111": true, "00000000": true,
+		"qwertyui": true, "qwerty123": true, "abc12345": true, "admin123": true,
+		"iloveyou": true, "letmein1": true, "welcome1": true, "sunshine": true,
+		"football": true, "baseball": true, "princess": true, "trustno1": true,
+	}
+)
+
+// ValidateUsername accepts 3 to 32 letters, digits, "_", "." or "-",
+// starting with a letter.
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("%w: use 3-32 letters, digits, _ . or -, starting with a letter", ErrInvalidUsername)
+	}
+	return nil
+}
+
+// ValidatePassword enforces the password policy for the given user.
+func ValidatePassword(username, rawPw string) error {
+	if len(rawPw) < MinPasswordLength {
+		return fmt.Errorf("%w: need at least %d characters", ErrWeakPassword, MinPasswordLength)
+	}
+	if len(rawPw) > MaxPasswordLength {
+		return fmt.Errorf("%w: need at most %d bytes", ErrWeakPassword, MaxPasswordLength)
+	}
+	if commonPasswords[strings.ToLower(rawPw)] {
+		return fmt.Errorf("%w: password is too common", ErrWeakPassword)
+	}
+	if strings.Contains(strings.ToLower(rawPw), strings.ToLower(username)) {
+		return fmt.Errorf("%w: password contains the username", ErrWeakPassword)
+	}
+	return nil
+}
+
 type User struct {
+	// ID is given by the store and never changes, a user deleted and
+	// registered again under the same name gets a new one.
+	ID       string
 	UserName string
 	HashPw   string
 	Role     string
+	Disabled bool
+	// Organization shares the laptops of its members, see CanModifyLaptop.
+	Organization string
+	// Tenant owns the catalog the user works on, DefaultTenant if empty.
+	Tenant string
+	// ExternalID is the OIDC issuer and subject of a user signed in by an
+	// identity provider, who has no password.
+	ExternalID string
 }
 
 func (u *User) IsCorrectPw(rawPw string) bool {
@@ -32,8 +97,18 @@ func (u *User) Clone() *User {
 	return clone
 }
 
+// SetPassword replaces the password hash of the user.
+func (u *User) SetPassword(rawPw string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(rawPw), passwordCost)
+	if err != nil {
+		return err
+	}
+	u.HashPw = string(hash)
+	return nil
+}
+
 func NewUser(username, rawPw, role string) (*User, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(rawPw), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(rawPw), passwordCost)
 	if err != nil {
 		return nil, err
 	}
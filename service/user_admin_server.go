@@ -0,0 +1,322 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultUsersPageSize = 50
+	maxUsersPageSize     = 500
+)
+
+type UserAdminServer struct {
+	userStore    UserStore
+	tenantStore  TenantStore
+	loginLimiter *LoginLimiter
+	roles        []string
+	pb.UnimplementedUserAdminServiceServer
+}
+
+// NewUserAdminServer returns a server managing the users of userStore and
+// the tenants of tenantStore. SetUserRole only accepts the given roles.
+// Admins only see the users of their own tenant, super admins see them all.
+func NewUserAdminServer(userStore UserStore,
+	tenantStore TenantStore,
+	loginLimiter *LoginLimiter,
+	roles []string) *UserAdminServer {
+	return &UserAdminServer{
+		userStore:    userStore,
+		tenantStore:  tenantStore,
+		loginLimiter: loginLimiter,
+		roles:        roles,
+	}
+}
+
+func (s *UserAdminServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultUsersPageSize
+	}
+	if pageSize > maxUsersPageSize {
+		pageSize = maxUsersPageSize
+	}
+
+	// ask for one more to know if there is a next page
+	users, err := s.listVisibleUsers(ctx, req.GetPageToken(), pageSize+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant list users: %v", err)
+	}
+
+	res := &pb.ListUsersResponse{}
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		res.NextPageToken = users[pageSize-1].UserName
+	}
+	for _, user := range users {
+		res.Users = append(res.Users, toUserAccount(user))
+	}
+
+	return res, nil
+}
+
+func (s *UserAdminServer) SetUserRole(ctx context.Context, req *pb.SetUserRoleRequest) (*pb.SetUserRoleResponse, error) {
+	role, ok := s.findRole(req.GetRole())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role %q, expect one of %v", req.GetRole(), s.roles)
+	}
+
+	if strings.EqualFold(role, SuperAdminRole) && !isSuperAdmin(ctx) {
+		return nil, status.Errorf(codes.PermissionDenied, "only a super admin can grant role %v", role)
+	}
+
+	user, err := s.updateUser(ctx, req.GetUsername(), func(user *User) {
+		user.Role = role
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetUserRoleResponse{User: toUserAccount(user)}, nil
+}
+
+func (s *UserAdminServer) DisableUser(ctx context.Context, req *pb.DisableUserRequest) (*pb.DisableUserResponse, error) {
+	user, err := s.updateUser(ctx, req.GetUsername(), func(user *User) {
+		user.Disabled = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DisableUserResponse{User: toUserAccount(user)}, nil
+}
+
+func (s *UserAdminServer) EnableUser(ctx context.Context, req *pb.EnableUserRequest) (*pb.EnableUserResponse, error) {
+	user, err := s.updateUser(ctx, req.GetUsername(), func(user *User) {
+		user.Disabled = false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.EnableUserResponse{User: toUserAccount(user)}, nil
+}
+
+func (s *UserAdminServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	err := checkNotSelf(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userStore.Find(req.GetUsername())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "cant find user: %v", err)
+	}
+	err = checkCanManage(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.userStore.Delete(req.GetUsername())
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotExist) {
+			code = codes.NotFound
+		}
+		return nil, status.Errorf(code, "cant delete user: %v", err)
+	}
+
+	return &pb.DeleteUserResponse{}, nil
+}
+
+func (s *UserAdminServer) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	user, err := s.userStore.Find(req.GetUsername())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "cant find user: %v", err)
+	}
+	err = checkCanManage(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	s.loginLimiter.Unlock(user.UserName)
+
+	return &pb.UnlockUserResponse{User: toUserAccount(user)}, nil
+}
+
+func (s *UserAdminServer) CreateTenant(ctx context.Context, req *pb.CreateTenantRequest) (*pb.CreateTenantResponse, error) {
+	tenant := &Tenant{ID: req.GetTenant().GetId(), Name: req.GetTenant().GetName()}
+
+	err := ValidateTenantID(tenant.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	err = s.tenantStore.Save(tenant)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExist) {
+			code = codes.AlreadyExists
+		}
+		return nil, status.Errorf(code, "cant save tenant: %v", err)
+	}
+
+	return &pb.CreateTenantResponse{Tenant: toPBTenant(tenant)}, nil
+}
+
+func (s *UserAdminServer) ListTenants(ctx context.Context, req *pb.ListTenantsRequest) (*pb.ListTenantsResponse, error) {
+	tenants, err := s.tenantStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant list tenants: %v", err)
+	}
+
+	res := &pb.ListTenantsResponse{}
+	for _, tenant := range tenants {
+		res.Tenants = append(res.Tenants, toPBTenant(tenant))
+	}
+
+	return res, nil
+}
+
+func (s *UserAdminServer) SetUserTenant(ctx context.Context, req *pb.SetUserTenantRequest) (*pb.SetUserTenantResponse, error) {
+	tenant := req.GetTenant()
+	if tenant != DefaultTenant {
+		_, err := s.tenantStore.Find(tenant)
+		if err != nil {
+			code := codes.Internal
+			if errors.Is(err, ErrNotExist) {
+				code = codes.NotFound
+			}
+			return nil, status.Errorf(code, "cant find tenant %q: %v", tenant, err)
+		}
+	}
+
+	user, err := s.updateUser(ctx, req.GetUsername(), func(user *User) {
+		user.Tenant = tenant
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetUserTenantResponse{User: toUserAccount(user)}, nil
+}
+
+// listVisibleUsers pages through the store until it has limit users the
+// caller may see.
+func (s *UserAdminServer) listVisibleUsers(ctx context.Context, after string, limit int) ([]*User, error) {
+	var visible []*User
+	for len(visible) < limit {
+		users, err := s.userStore.List(after, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range users {
+			if canSeeUser(ctx, user) {
+				visible = append(visible, user)
+			}
+		}
+
+		if len(users) < limit {
+			break
+		}
+		after = users[len(users)-1].UserName
+	}
+
+	if len(visible) > limit {
+		visible = visible[:limit]
+	}
+	return visible, nil
+}
+
+func (s *UserAdminServer) updateUser(ctx context.Context, username string, update func(user *User)) (*User, error) {
+	err := checkNotSelf(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	// the checks run on the user as saved, so two admins cant undo each
+	// other's changes
+	user, err := s.userStore.Update(username, func(user *User) error {
+		err := checkCanManage(ctx, user)
+		if err != nil {
+			return err
+		}
+		update(user)
+		return nil
+	})
+	if errors.Is(err, ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "cant find user: %v", err)
+	}
+	if err != nil {
+		// the checks return a status
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "cant save user: %v", err)
+	}
+
+	return user, nil
+}
+
+func (s *UserAdminServer) findRole(role string) (string, bool) {
+	for _, known := range s.roles {
+		if strings.EqualFold(known, role) {
+			return known, true
+		}
+	}
+	return "", false
+}
+
+// checkNotSelf stops admins from locking themselves out.
+func checkNotSelf(ctx context.Context, username string) error {
+	claims := UserClaimsFromContext(ctx)
+	if claims != nil && claims.Username == username {
+		return status.Errorf(codes.FailedPrecondition, "cant change your own account")
+	}
+	return nil
+}
+
+// checkCanManage stops admins from changing super admin accounts and the
+// users of other tenants.
+func checkCanManage(ctx context.Context, user *User) error {
+	if !canSeeUser(ctx, user) {
+		return status.Errorf(codes.NotFound, "cant find user %v", user.UserName)
+	}
+	if strings.EqualFold(user.Role, SuperAdminRole) && !isSuperAdmin(ctx) {
+		return status.Errorf(codes.PermissionDenied, "only a super admin can change user %v", user.UserName)
+	}
+	return nil
+}
+
+// canSeeUser hides the users of the other tenants from the admins.
+func canSeeUser(ctx context.Context, user *User) bool {
+	return isSuperAdmin(ctx) || user.Tenant == TenantFromContext(ctx)
+}
+
+func isSuperAdmin(ctx context.Context) bool {
+	claims := UserClaimsFromContext(ctx)
+	return claims != nil && strings.EqualFold(claims.Role, SuperAdminRole)
+}
+
+func toUserAccount(user *User) *pb.UserAccount {
+	return &pb.UserAccount{
+		Username:     user.UserName,
+		Role:         user.Role,
+		Disabled:     user.Disabled,
+		Organization: user.Organization,
+		Tenant:       user.Tenant,
+	}
+}
+
+func toPBTenant(tenant *Tenant) *pb.Tenant {
+	return &pb.Tenant{
+		Id:   tenant.ID,
+		Name: tenant.Name,
+	}
+}
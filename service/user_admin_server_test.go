@@ -0,0 +1,215 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/go-pcBookgRPC/pb"
+	"github.com/TranQuocToan1996/go-pcBookgRPC/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerListUsers(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, userStore.Save(&service.User{UserName: fmt.Sprintf("user%d", i), Role: "user"}))
+	}
+	server := service.NewUserAdminServer(userStore, service.NewInMemoryTenantStore(), service.NewLoginLimiter(service.DefaultLoginLimits), []string{"admin", "user"})
+
+	var usernames []string
+	req := &pb.ListUsersRequest{PageSize: 2}
+	for {
+		res, err := server.ListUsers(context.Background(), req)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(res.GetUsers()), 2)
+		for _, user := range res.GetUsers() {
+			usernames = append(usernames, user.GetUsername())
+		}
+		if res.GetNextPageToken() == "" {
+			break
+		}
+		req.PageToken = res.GetNextPageToken()
+	}
+
+	require.Equal(t, []string{"user0", "user1", "user2", "user3", "user4"}, usernames)
+}
+
+func TestServerManageUser(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	revocationStore := service.NewInMemoryRevocationStore()
+	authServer := service.NewAuthServer(userStore, jwtManager, revocationStore, service.NewLoginLimiter(service.DefaultLoginLimits), nil)
+	server := service.NewUserAdminServer(userStore, service.NewInMemoryTenantStore(), service.NewLoginLimiter(service.DefaultLoginLimits), []string{"admin", "user"})
+
+	bob, err := service.NewUser("bob", "bob-long-secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(bob))
+
+	login, err := authServer.Login(context.Background(), &pb.LoginRequest{Username: "bob", Password: "bob-long-secret"})
+	require.NoError(t, err)
+
+	interceptor := service.NewAuthInterceptor(jwtManager, userStore, revocationStore, service.NewInMemoryAPIKeyStore(),
+		newTestPolicy(t, map[string]string{"/pb.LaptopService/CreateLaptop": "laptop.write"}))
+	callCreateLaptop := func() error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", login.GetAccessToken()))
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.LaptopService/CreateLaptop"}
+		_, err := interceptor.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+	require.Equal(t, codes.PermissionDenied, status.Code(callCreateLaptop()))
+
+	adminCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "root", Role: "admin"})
+
+	_, err = server.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "bob", Role: "superuser"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a role change applies to tokens already issued
+	res, err := server.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "bob", Role: "admin"})
+	require.NoError(t, err)
+	require.Equal(t, "admin", res.GetUser().GetRole())
+	require.NoError(t, callCreateLaptop())
+
+	_, err = server.DisableUser(adminCtx, &pb.DisableUserRequest{Username: "bob"})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unauthenticated, status.Code(callCreateLaptop()))
+
+	_, err = authServer.Login(context.Background(), &pb.LoginRequest{Username: "bob", Password: "bob-long-secret"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.EnableUser(adminCtx, &pb.EnableUserRequest{Username: "bob"})
+	require.NoError(t, err)
+	require.NoError(t, callCreateLaptop())
+
+	bobCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "bob", Role: "admin"})
+	_, err = server.DeleteUser(bobCtx, &pb.DeleteUserRequest{Username: "bob"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = server.DeleteUser(adminCtx, &pb.DeleteUserRequest{Username: "bob"})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unauthenticated, status.Code(callCreateLaptop()))
+
+	_, err = server.DeleteUser(adminCtx, &pb.DeleteUserRequest{Username: "bob"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServerConcurrentUserChanges(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	server := service.NewUserAdminServer(userStore, service.NewInMemoryTenantStore(), service.NewLoginLimiter(service.DefaultLoginLimits), []string{"admin", "user"})
+	adminCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "root", Role: "admin"})
+
+	for i := 0; i < 20; i++ {
+		username := fmt.Sprintf("user%d", i)
+		require.NoError(t, userStore.Save(&service.User{UserName: username, Role: "user"}))
+
+		// neither change may undo the other
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := server.DisableUser(adminCtx, &pb.DisableUserRequest{Username: username})
+			require.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := server.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: username, Role: "admin"})
+			require.NoError(t, err)
+		}()
+		wg.Wait()
+
+		user, err := userStore.Find(username)
+		require.NoError(t, err)
+		require.True(t, user.Disabled)
+		require.Equal(t, "admin", user.Role)
+	}
+}
+
+func TestServerManageSuperAdmin(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	server := service.NewUserAdminServer(userStore, service.NewInMemoryTenantStore(), service.NewLoginLimiter(service.DefaultLoginLimits), []string{service.SuperAdminRole, "admin", "user"})
+
+	root, err := service.NewUser("root", "root-long-secret", service.SuperAdminRole)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(root))
+	bob, err := service.NewUser("bob", "bob-long-secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(bob))
+
+	adminCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "alice", Role: "admin"})
+	superCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "root2", Role: service.SuperAdminRole})
+
+	_, err = server.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "bob", Role: service.SuperAdminRole})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DisableUser(adminCtx, &pb.DisableUserRequest{Username: "root"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DeleteUser(adminCtx, &pb.DeleteUserRequest{Username: "root"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err := server.SetUserRole(superCtx, &pb.SetUserRoleRequest{Username: "bob", Role: service.SuperAdminRole})
+	require.NoError(t, err)
+	require.Equal(t, service.SuperAdminRole, res.GetUser().GetRole())
+}
+
+func TestServerManageTenants(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	server := service.NewUserAdminServer(userStore, service.NewInMemoryTenantStore(), service.NewLoginLimiter(service.DefaultLoginLimits), []string{"admin", "user"})
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		user, err := service.NewUser(username, username+"-long-secret", "user")
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+	}
+
+	superCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "root", Role: service.SuperAdminRole})
+
+	_, err := server.CreateTenant(superCtx, &pb.CreateTenantRequest{Tenant: &pb.Tenant{Id: "Not Valid"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.CreateTenant(superCtx, &pb.CreateTenantRequest{Tenant: &pb.Tenant{Id: "acme", Name: "Acme"}})
+	require.NoError(t, err)
+	_, err = server.CreateTenant(superCtx, &pb.CreateTenantRequest{Tenant: &pb.Tenant{Id: "acme"}})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	tenants, err := server.ListTenants(superCtx, &pb.ListTenantsRequest{})
+	require.NoError(t, err)
+	require.Len(t, tenants.GetTenants(), 1)
+	require.Equal(t, "Acme", tenants.GetTenants()[0].GetName())
+
+	_, err = server.SetUserTenant(superCtx, &pb.SetUserTenantRequest{Username: "alice", Tenant: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	for _, username := range []string{"alice", "bob"} {
+		res, err := server.SetUserTenant(superCtx, &pb.SetUserTenantRequest{Username: username, Tenant: "acme"})
+		require.NoError(t, err)
+		require.Equal(t, "acme", res.GetUser().GetTenant())
+	}
+
+	// admins only see the users of their tenant
+	acmeCtx := service.ContextWithUserClaims(context.Background(), &service.UserClaims{Username: "dave", Role: "admin", Tenant: "acme"})
+	res, err := server.ListUsers(acmeCtx, &pb.ListUsersRequest{PageSize: 1})
+	require.NoError(t, err)
+	require.Equal(t, "alice", res.GetUsers()[0].GetUsername())
+	res, err = server.ListUsers(acmeCtx, &pb.ListUsersRequest{PageSize: 1, PageToken: res.GetNextPageToken()})
+	require.NoError(t, err)
+	require.Equal(t, "bob", res.GetUsers()[0].GetUsername())
+	require.Empty(t, res.GetNextPageToken())
+
+	_, err = server.DisableUser(acmeCtx, &pb.DisableUserRequest{Username: "carol"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -2,12 +2,24 @@ package service
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+
+	"github.com/google/uuid"
 )
 
 type UserStore interface {
+	// Save gives the user a new ID when it has none.
 	Save(user *User) error
+	// Update calls update with a copy of the user and saves it unless
+	// update fails, with no other change in between. It returns the saved
+	// user.
+	Update(username string, update func(user *User) error) (*User, error)
+	Delete(username string) error
 	Find(username string) (*User, error)
+	// List returns up to limit users ordered by username, starting after
+	// the given username.
+	List(after string, limit int) ([]*User, error)
 }
 
 type InMemoryUserStore struct {
@@ -29,12 +41,72 @@ func (store *InMemoryUserStore) Save(user *User) error {
 	if found != nil {
 		return ErrAlreadyExist
 	}
+	if len(user.ID) == 0 {
+		user.ID = uuid.NewString()
+	}
 
 	store.users[user.UserName] = user.Clone()
 
 	return nil
 }
 
+func (store *InMemoryUserStore) Update(username string, update func(user *User) error) (*User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	found := store.users[username]
+	if found == nil {
+		return nil, ErrNotExist
+	}
+
+	user := found.Clone()
+	err := update(user)
+	if err != nil {
+		return nil, err
+	}
+	if user.UserName != username || user.ID != found.ID {
+		return nil, fmt.Errorf("cant rename user %v", username)
+	}
+
+	store.users[username] = user.Clone()
+	return user, nil
+}
+
+func (store *InMemoryUserStore) Delete(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.users[username] == nil {
+		return ErrNotExist
+	}
+
+	delete(store.users, username)
+	return nil
+}
+
+func (store *InMemoryUserStore) List(after string, limit int) ([]*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	usernames := make([]string, 0, len(store.users))
+	for username := range store.users {
+		if username > after {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+
+	if len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+
+	users := make([]*User, 0, len(usernames))
+	for _, username := range usernames {
+		users = append(users, store.users[username].Clone())
+	}
+	return users, nil
+}
+
 func (store *InMemoryUserStore) Find(username string) (*User, error) {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()